@@ -0,0 +1,119 @@
+package logstash
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Parsers for the access logs of web servers.
+const (
+	// ParserCommon decodes lines in the Common Log Format.
+	ParserCommon = "common"
+	// ParserCombined decodes lines in the combined format of nginx and
+	// Apache, which adds the referrer and user agent to the Common Log
+	// Format.
+	ParserCombined = "combined"
+	// ParserNginx decodes the access log of nginx: the combined format,
+	// optionally followed by the X-Forwarded-For header and the request time.
+	ParserNginx = "nginx"
+	// ParserApache decodes the access log of Apache, in either the common or
+	// the combined format.
+	ParserApache = "apache"
+)
+
+// clfPattern matches the Common Log Format. Requests that aren't a method
+// and a path, such as those of clients that sent garbage, are kept whole.
+const clfPattern = `^%{IPORHOST:client_ip} %{NOTSPACE:ident} %{NOTSPACE:remote_user} \[%{HTTPDATE:time}\] ` +
+	`"(?:%{WORD:method} %{NOTSPACE:path}(?: HTTP/%{NUMBER:http_version})?|(?<request>(?:[^"\\]|\\.)*))" ` +
+	`%{NUMBER:status:int} (?:%{NUMBER:bytes:int}|-)`
+
+// quotedField matches a quoted field of an access log, capturing its text.
+func quotedField(name string) string {
+	return `"(?<` + name + `>(?:[^"\\]|\\.)*)"`
+}
+
+var accessParsers = map[string]*grokPattern{
+	ParserCommon:   mustCompileGrok(clfPattern),
+	ParserCombined: mustCompileGrok(clfPattern + ` ` + quotedField("referrer") + ` ` + quotedField("user_agent")),
+	ParserNginx: mustCompileGrok(clfPattern + ` ` + quotedField("referrer") + ` ` + quotedField("user_agent") +
+		`(?: ` + quotedField("forwarded_for") + `)?(?: (?:rt=|request_time=)?%{NUMBER:request_time:float}\b)?`),
+	ParserApache: mustCompileGrok(clfPattern + `(?: ` + quotedField("referrer") + ` ` + quotedField("user_agent") + `)?`),
+}
+
+func mustCompileGrok(pattern string) *grokPattern {
+	g, err := compileGrok(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// accessParser returns the line parser for the named access log pattern.
+// Fields logged as "-", which web servers write for missing values, are left
+// out.
+func accessParser(name string) func(a *LogstashAdapter, line string) (map[string]interface{}, bool) {
+	g := accessParsers[name]
+	return func(a *LogstashAdapter, line string) (map[string]interface{}, bool) {
+		data, ok := g.parse(line)
+		if !ok {
+			return nil, false
+		}
+		for k, v := range data {
+			if v == "-" && k != "message" {
+				delete(data, k)
+			}
+		}
+		return data, true
+	}
+}
+
+// imageParsers are the parsers detected from the names of images.
+var imageParsers = map[string]string{
+	"nginx":     ParserNginx,
+	"openresty": ParserNginx,
+	"httpd":     ParserApache,
+	"apache":    ParserApache,
+	"apache2":   ParserApache,
+}
+
+// detectParser returns the parser for the logs of a container's image, or an
+// empty string if there is none. Detection is turned on with the label
+// logstash.detect_parser or the environment variable LOGSTASH_DETECT_PARSER.
+// Images, as in the image field of DockerInfo, are recognised by the last
+// part of their name, so bitnami/nginx and nginx-unprivileged are nginx as
+// well as nginx itself.
+func detectParser(c *docker.Container, a *LogstashAdapter) string {
+	detect := containerSetting(c, a, "logstash.detect_parser", "LOGSTASH_DETECT_PARSER")
+	if detect == "" {
+		return ""
+	}
+	on, err := strconv.ParseBool(detect)
+	if err != nil {
+		a.log.with("container", c.ID).warnf("invalid detect_parser %s", detect)
+		return ""
+	}
+	if !on {
+		return ""
+	}
+	return imageParser(c.Config.Image)
+}
+
+// imageParser returns the parser for the logs of an image, or an empty
+// string if there is none.
+func imageParser(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, "/"); i >= 0 {
+		image = image[i+1:]
+	}
+	if i := strings.Index(image, ":"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.IndexAny(image, "-_."); i >= 0 {
+		image = image[:i]
+	}
+	return imageParsers[image]
+}
@@ -0,0 +1,114 @@
+package logstash
+
+import (
+	"encoding/json"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNginx(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	line := `172.17.0.1 - alice [05/Apr/2023:06:07:08 +0000] "GET /index.html?q=1 HTTP/1.1" 200 612 "https://example.com/" "Mozilla/5.0 (X11; Linux x86_64)" "10.0.0.1, 10.0.0.2" 0.003`
+	assert.Equal(map[string]interface{}{
+		"message":       line,
+		"client_ip":     "172.17.0.1",
+		"remote_user":   "alice",
+		"time":          "05/Apr/2023:06:07:08 +0000",
+		"method":        "GET",
+		"path":          "/index.html?q=1",
+		"http_version":  "1.1",
+		"status":        int64(200),
+		"bytes":         int64(612),
+		"referrer":      "https://example.com/",
+		"user_agent":    "Mozilla/5.0 (X11; Linux x86_64)",
+		"forwarded_for": "10.0.0.1, 10.0.0.2",
+		"request_time":  0.003,
+	}, adapter.parseLine(ParserNginx, line))
+
+	// the default format of the nginx image, with missing values
+	data := adapter.parseLine(ParserNginx, `::1 - - [05/Apr/2023:06:07:08 +0000] "\x16\x03\x01" 400 - "-" "-" "-"`)
+	assert.Equal("::1", data["client_ip"])
+	assert.Equal(`\x16\x03\x01`, data["request"])
+	assert.Equal(int64(400), data["status"])
+	for _, field := range []string{"remote_user", "ident", "bytes", "referrer", "user_agent", "forwarded_for", "method"} {
+		assert.NotContains(data, field)
+	}
+
+	// error log lines are sent as they are
+	line = `2023/04/05 06:07:08 [error] 29#29: *1 open() "/usr/share/nginx/html/x" failed`
+	assert.Equal(map[string]interface{}{"message": line}, adapter.parseLine(ParserNginx, line))
+}
+
+func TestParseApache(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	common := `192.168.1.20 - - [05/Apr/2023:06:07:08 +0000] "POST /login HTTP/1.0" 302 -`
+	combined := common + ` "-" "curl/8.0 \"quoted\""`
+
+	data := adapter.parseLine(ParserApache, common)
+	assert.Equal("POST", data["method"])
+	assert.Equal(int64(302), data["status"])
+	assert.NotContains(data, "user_agent")
+
+	data = adapter.parseLine(ParserApache, combined)
+	assert.Equal(`curl/8.0 \"quoted\"`, data["user_agent"])
+	assert.Equal(data, adapter.parseLine(ParserCombined, combined))
+	assert.Equal(map[string]interface{}{"message": common}, adapter.parseLine(ParserCombined, common))
+	assert.Equal("/login", adapter.parseLine(ParserCommon, combined)["path"])
+}
+
+func TestImageParser(t *testing.T) {
+	assert := assert.New(t)
+
+	for image, parser := range map[string]string{
+		"nginx":                          ParserNginx,
+		"nginx:1.25-alpine":              ParserNginx,
+		"docker.io/bitnami/nginx:latest": ParserNginx,
+		"nginxinc/nginx-unprivileged@sha256:abcd": ParserNginx,
+		"registry.local:5000/openresty/openresty": ParserNginx,
+		"httpd:2.4":                    ParserApache,
+		"ubuntu/apache2":               ParserApache,
+		"registry.local:5000/team/api": "",
+		"redis":                        "",
+		"apache/airflow":               "",
+	} {
+		assert.Equal(parser, imageParser(image), image)
+	}
+}
+
+func TestDetectParser(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	parser := func(id, image string, labels map[string]string, env ...string) string {
+		return GetLineParser(&docker.Container{ID: id, Config: &docker.Config{Image: image, Labels: labels, Env: env}}, adapter)
+	}
+	assert.Equal(ParserJSON, parser("off", "nginx", nil))
+	assert.Equal(ParserNginx, parser("on", "nginx", nil, "LOGSTASH_DETECT_PARSER=true"))
+	assert.Equal(ParserJSON, parser("unknown", "redis", nil, "LOGSTASH_DETECT_PARSER=true"))
+	assert.Equal(ParserLogfmt, parser("explicit", "nginx", map[string]string{"logstash.parser": "logfmt", "logstash.detect_parser": "true"}))
+	assert.Equal(ParserApache, parser("label", "httpd", map[string]string{"logstash.detect_parser": "true"}))
+}
+
+func TestStreamAccessLog(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	streamSourcedLines(adapter, &docker.Container{ID: "ID", Name: "web", Config: &docker.Config{
+		Image:  "nginx:1.25",
+		Labels: map[string]string{"logstash.detect_parser": "true"},
+	}}, stdoutLines(`10.0.0.1 - - [05/Apr/2023:06:07:08 +0000] "GET / HTTP/1.1" 200 615 "-" "curl/8.0"`)...)
+
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(conn.Writes()[0]), &data))
+	assert.Equal("10.0.0.1", data["client_ip"])
+	assert.Equal(float64(200), data["status"])
+	assert.Equal("curl/8.0", data["user_agent"])
+	assert.Equal("stdout", data["stream"])
+}
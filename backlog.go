@@ -0,0 +1,119 @@
+package logstash
+
+import (
+	"sync/atomic"
+)
+
+// DefaultRetryBuffer is the number of events kept in memory while Logstash
+// can't be reached and no spool is configured.
+const DefaultRetryBuffer = 10000
+
+// backlog holds events that couldn't be written yet, oldest first.
+type backlog interface {
+	// append adds events to the end of the backlog, dropping the oldest
+	// events if it is full.
+	append(events []event) error
+	// peek returns up to max events from the head without removing them.
+	peek(max int) ([]event, error)
+	// discard removes the first n events returned by the last peek.
+	discard(n int) error
+	// empty reports whether the backlog holds no events.
+	empty() bool
+	// Dropped returns the number of events dropped because the backlog was full.
+	Dropped() uint64
+	// Close releases the files the backlog holds once the adapter is done
+	// with it.
+	Close() error
+}
+
+// configureBacklog sets up the in-memory retry buffer unless a spool was
+// configured.
+func (a *LogstashAdapter) configureBacklog() error {
+	if a.backlog != nil {
+		return nil
+	}
+	size, err := getoptInt(a.route, "retry_buffer", "LOGSTASH_RETRY_BUFFER", DefaultRetryBuffer)
+	if err != nil {
+		return err
+	}
+	b := newMemoryBacklog(size)
+	b.log = a.log
+	a.backlog = b
+	return nil
+}
+
+// memoryBacklog is a backlog that keeps up to max events in memory.
+type memoryBacklog struct {
+	events  []event
+	max     int
+	dropped uint64
+	log     *logger
+}
+
+func newMemoryBacklog(max int) *memoryBacklog {
+	return &memoryBacklog{max: max}
+}
+
+func (b *memoryBacklog) append(events []event) error {
+	b.events = append(b.events, events...)
+	if over := len(b.events) - b.max; over > 0 {
+		atomic.AddUint64(&b.dropped, uint64(over))
+		b.log.warnf("retry buffer full, dropped %d events", over)
+		b.events = append([]event(nil), b.events[over:]...)
+	}
+	return nil
+}
+
+func (b *memoryBacklog) peek(max int) ([]event, error) {
+	if max > len(b.events) {
+		max = len(b.events)
+	}
+	return b.events[:max], nil
+}
+
+func (b *memoryBacklog) discard(n int) error {
+	b.events = b.events[n:]
+	if len(b.events) == 0 {
+		b.events = nil
+	}
+	return nil
+}
+
+func (b *memoryBacklog) empty() bool {
+	return len(b.events) == 0
+}
+
+func (b *memoryBacklog) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+func (b *memoryBacklog) Close() error {
+	return nil
+}
+
+// replay writes backlogged events in order until the backlog is empty or a
+// write fails.
+func (a *LogstashAdapter) replay() {
+	if a.backlog == nil {
+		return
+	}
+	max := a.batchSize
+	if max < 1 {
+		max = DefaultBatchSize
+	}
+	for !a.backlog.empty() {
+		events, err := a.backlog.peek(max)
+		if err != nil {
+			a.log.errorf("could not read backlog: %s", err)
+			return
+		}
+		n, err := a.writeBatch(events)
+		if err := a.backlog.discard(n); err != nil {
+			a.log.errorf("could not discard delivered events: %s", err)
+			return
+		}
+		if err != nil || len(events) == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package logstash
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Ways of spreading events over the endpoints of a route.
+const (
+	// BalanceFailover sends everything to the first reachable endpoint,
+	// in the order they're listed.
+	BalanceFailover = "failover"
+	// BalanceRoundRobin sends each batch to the next reachable endpoint.
+	BalanceRoundRobin = "roundrobin"
+	// BalanceHash sends all events of a container to the same reachable
+	// endpoint, so they stay in order.
+	BalanceHash = "hash"
+)
+
+// endpoint is one Logstash address of a route. An endpoint without a
+// connection is out of rotation until its backoff has passed and it can be
+// redialed.
+type endpoint struct {
+	address  string
+	conn     net.Conn
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+// configureEndpoints splits the route address into endpoints and reads the
+// balancing mode. Addresses are separated by semicolons, as logspout splits
+// ROUTE_URIS and its route argument on commas; commas still separate them in
+// routes created through logspout's routes API.
+func (a *LogstashAdapter) configureEndpoints() error {
+	a.endpoints = nil
+	for _, address := range strings.FieldsFunc(a.route.Address, isAddressSeparator) {
+		if address = strings.TrimSpace(address); address != "" {
+			a.endpoints = append(a.endpoints, &endpoint{address: address})
+		}
+	}
+	if len(a.endpoints) == 0 {
+		return errors.New("no logstash address given")
+	}
+
+	a.balance = getopt(a.route, "balance", "LOGSTASH_BALANCE", BalanceFailover)
+	switch a.balance {
+	case BalanceFailover, BalanceRoundRobin, BalanceHash:
+		return nil
+	}
+	return errors.New("unknown balance mode: " + a.balance)
+}
+
+func isAddressSeparator(r rune) bool {
+	return r == ';' || r == ','
+}
+
+// dialAll connects to every endpoint, scheduling a redial for those that
+// can't be reached. It fails only if none of them could be reached.
+func (a *LogstashAdapter) dialAll() error {
+	var err error
+	connected := false
+	for _, e := range a.endpoints {
+		conn, dialErr := a.transport.Dial(e.address, a.route.Options)
+		if dialErr != nil {
+			err = dialErr
+			a.retryLater(e)
+			continue
+		}
+		e.conn = conn
+		connected = true
+	}
+	if connected {
+		return nil
+	}
+	return err
+}
+
+// assign picks an endpoint for each event, skipping endpoints in exclude.
+// An event gets no endpoint if none of them can be reached.
+func (a *LogstashAdapter) assign(batch []event, exclude map[*endpoint]bool) []*endpoint {
+	targets := make([]*endpoint, len(batch))
+
+	usable := func(e *endpoint) bool {
+		return !exclude[e] && a.connected(e) == nil
+	}
+
+	switch a.balance {
+	case BalanceHash:
+		var healthy []*endpoint
+		for _, e := range a.endpoints {
+			if usable(e) {
+				healthy = append(healthy, e)
+			}
+		}
+		if len(healthy) == 0 {
+			return targets
+		}
+		for i, ev := range batch {
+			targets[i] = rendezvous(ev.key, healthy)
+		}
+	case BalanceRoundRobin:
+		for i := range a.endpoints {
+			e := a.endpoints[(a.next+i)%len(a.endpoints)]
+			if usable(e) {
+				a.next = (a.next + i + 1) % len(a.endpoints)
+				for i := range targets {
+					targets[i] = e
+				}
+				break
+			}
+		}
+	default:
+		for _, e := range a.endpoints {
+			if usable(e) {
+				for i := range targets {
+					targets[i] = e
+				}
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// rendezvous picks the endpoint with the highest hash of key and address,
+// so only the keys of an endpoint that leaves rotation move elsewhere.
+func rendezvous(key string, endpoints []*endpoint) *endpoint {
+	var best *endpoint
+	var bestScore uint64
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(e.address))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
+
+// writeBatch writes a batch to the route's endpoints. Events whose endpoint
+// fails are retried on the remaining ones. It returns the number of events at
+// the start of the batch that were written; events after that may be written
+// again later.
+func (a *LogstashAdapter) writeBatch(batch []event) (int, error) {
+	written := make([]bool, len(batch))
+	failed := make(map[*endpoint]bool)
+	pending := make([]int, len(batch))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	err := errNotConnected
+	for len(pending) > 0 {
+		events := make([]event, len(pending))
+		for i, j := range pending {
+			events[i] = batch[j]
+		}
+
+		var order []*endpoint
+		groups := make(map[*endpoint][]int)
+		for i, e := range a.assign(events, failed) {
+			if e == nil {
+				continue
+			}
+			if _, ok := groups[e]; !ok {
+				order = append(order, e)
+			}
+			groups[e] = append(groups[e], pending[i])
+		}
+		if len(order) == 0 {
+			break
+		}
+
+		var retry []int
+		for _, e := range order {
+			group := groups[e]
+			events := make([]event, len(group))
+			for i, j := range group {
+				events[i] = batch[j]
+			}
+			if writeErr := a.writeTo(e, events); writeErr != nil {
+				err = writeErr
+				failed[e] = true
+				retry = append(retry, group...)
+				continue
+			}
+			for _, j := range group {
+				written[j] = true
+			}
+		}
+		sort.Ints(retry)
+		pending = retry
+	}
+
+	n := 0
+	for n < len(batch) && written[n] {
+		n++
+	}
+	if n == len(batch) {
+		return n, nil
+	}
+	return n, err
+}
+
+// writeTo writes events to an endpoint, packed into a single write on stream
+// transports and one write per event on UDP. Writes that take longer than
+// the write timeout fail, so a Logstash that stops reading doesn't hold up
+// the events behind them.
+func (a *LogstashAdapter) writeTo(e *endpoint, batch []event) error {
+	if a.writeTimeout > 0 {
+		e.conn.SetWriteDeadline(time.Now().Add(a.writeTimeout))
+	}
+	if a.isDatagram() || len(batch) == 1 {
+		for _, ev := range batch {
+			var err error
+			if a.format == FormatGELF && a.isDatagram() {
+				err = a.writeGELFChunks(e, ev.data)
+			} else {
+				_, err = e.conn.Write(ev.data)
+			}
+			if err != nil {
+				a.disconnect(e, err)
+				return err
+			}
+		}
+		a.metrics.written(e.address, batch)
+		a.connectionHealthy(e)
+		return nil
+	}
+
+	size := 0
+	for _, ev := range batch {
+		size += len(ev.data)
+	}
+	buf := make([]byte, 0, size)
+	for _, ev := range batch {
+		buf = append(buf, ev.data...)
+	}
+	if _, err := e.conn.Write(buf); err != nil {
+		a.disconnect(e, err)
+		return err
+	}
+	a.metrics.written(e.address, batch)
+	a.connectionHealthy(e)
+	return nil
+}
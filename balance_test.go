@@ -0,0 +1,215 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+// addressTransport dials a recordingConn per address, or fails for
+// addresses without one.
+type addressTransport map[string]*recordingConn
+
+func (t addressTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	if conn, ok := t[addr]; ok {
+		return conn, nil
+	}
+	return nil, errors.New("connection refused")
+}
+
+func newBalancingAdapter(balance string, transport addressTransport, addresses ...string) *LogstashAdapter {
+	adapter := newBatchingAdapter("logstash+tcp", nil)
+	adapter.queueSize = 0
+	adapter.transport = transport
+	adapter.balance = balance
+	adapter.endpoints = nil
+	for _, address := range addresses {
+		adapter.endpoints = append(adapter.endpoints, &endpoint{address: address})
+	}
+	return adapter
+}
+
+func keyedEvents(keys ...string) []event {
+	var result []event
+	for _, key := range keys {
+		result = append(result, event{key: key, data: []byte(key + "\n")})
+	}
+	return result
+}
+
+func TestConfigureEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: &router.Route{
+		Address: "one:5000, two:5000,",
+		Options: map[string]string{"balance": "roundrobin"},
+	}}
+	assert.Nil(adapter.configureEndpoints())
+	assert.Len(adapter.endpoints, 2)
+	assert.Equal("one:5000", adapter.endpoints[0].address)
+	assert.Equal("two:5000", adapter.endpoints[1].address)
+	assert.Equal(BalanceRoundRobin, adapter.balance)
+
+	adapter.route.Address = "one:5000;two:5000"
+	assert.Nil(adapter.configureEndpoints())
+	assert.Len(adapter.endpoints, 2)
+	assert.Equal("two:5000", adapter.endpoints[1].address)
+
+	adapter.route.Options["balance"] = "random"
+	assert.NotNil(adapter.configureEndpoints())
+
+	adapter.route.Options["balance"] = ""
+	assert.Nil(adapter.configureEndpoints())
+	assert.Equal(BalanceFailover, adapter.balance)
+}
+
+// routesFromURIs parses ROUTE_URIS the way logspout does: split on commas,
+// with the host of each URI as the address and its query as the options.
+func routesFromURIs(t *testing.T, uris string) []*router.Route {
+	var routes []*router.Route
+	for _, uri := range strings.Split(uris, ",") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		route := &router.Route{Adapter: u.Scheme, Address: u.Host, Options: make(map[string]string)}
+		for key := range u.Query() {
+			route.Options[key] = u.Query().Get(key)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+func TestConfigureEndpointsFromRouteURI(t *testing.T) {
+	assert := assert.New(t)
+
+	routes := routesFromURIs(t, "logstash+tcp://logstash1:5000;logstash2:5000;logstash3:5000?balance=hash")
+	assert.Len(routes, 1)
+	adapter := &LogstashAdapter{route: routes[0]}
+	assert.Nil(adapter.configureEndpoints())
+	var addresses []string
+	for _, e := range adapter.endpoints {
+		addresses = append(addresses, e.address)
+	}
+	assert.Equal([]string{"logstash1:5000", "logstash2:5000", "logstash3:5000"}, addresses)
+	assert.Equal(BalanceHash, adapter.balance)
+}
+
+func TestBalanceFailover(t *testing.T) {
+	assert := assert.New(t)
+
+	one, two := &recordingConn{}, &recordingConn{}
+	transport := addressTransport{"one": one, "two": two}
+	adapter := newBalancingAdapter(BalanceFailover, transport, "one", "two")
+	assert.Nil(adapter.dialAll())
+
+	n, err := adapter.writeBatch(keyedEvents("a", "b"))
+	assert.Nil(err)
+	assert.Equal(2, n)
+	assert.Equal([]string{"a\nb\n"}, one.Writes())
+
+	// the first endpoint fails mid-batch, so the second takes over
+	one.SetError(errors.New("broken pipe"))
+	delete(transport, "one")
+	n, err = adapter.writeBatch(keyedEvents("c"))
+	assert.Nil(err)
+	assert.Equal(1, n)
+	assert.Equal([]string{"c\n"}, two.Writes())
+	assert.Nil(adapter.endpoints[0].conn)
+
+	// and the first comes back into rotation once it can be redialed
+	one.SetError(nil)
+	transport["one"] = one
+	n, err = adapter.writeBatch(keyedEvents("d"))
+	assert.Nil(err)
+	assert.Equal(1, n)
+	assert.Equal([]string{"a\nb\n", "d\n"}, one.Writes())
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	assert := assert.New(t)
+
+	one, two := &recordingConn{}, &recordingConn{}
+	adapter := newBalancingAdapter(BalanceRoundRobin, addressTransport{"one": one, "two": two}, "one", "two")
+	assert.Nil(adapter.dialAll())
+
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := adapter.writeBatch(keyedEvents(key))
+		assert.Nil(err)
+	}
+	assert.Equal([]string{"a\n", "c\n"}, one.Writes())
+	assert.Equal([]string{"b\n"}, two.Writes())
+}
+
+func TestBalanceHash(t *testing.T) {
+	assert := assert.New(t)
+
+	conns := []*recordingConn{{}, {}, {}}
+	transport := addressTransport{"one": conns[0], "two": conns[1], "three": conns[2]}
+	adapter := newBalancingAdapter(BalanceHash, transport, "one", "two", "three")
+	assert.Nil(adapter.dialAll())
+
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	n, err := adapter.writeBatch(keyedEvents(append(keys, keys...)...))
+	assert.Nil(err)
+	assert.Equal(2*len(keys), n)
+
+	owner := map[string]int{}
+	for i, conn := range conns {
+		for _, write := range conn.Writes() {
+			for _, line := range splitLines(write) {
+				if previous, ok := owner[line]; ok {
+					assert.Equal(previous, i, "container %s moved", line)
+				}
+				owner[line] = i
+			}
+		}
+	}
+	assert.Len(owner, len(keys))
+
+	// only the containers of an endpoint that goes away are moved
+	down := owner["a"]
+	conns[down].SetError(errors.New("broken pipe"))
+	for address, conn := range transport {
+		if conn == conns[down] {
+			delete(transport, address)
+		}
+	}
+	for _, conn := range conns {
+		conn.writes = nil
+	}
+	n, err = adapter.writeBatch(keyedEvents(keys...))
+	assert.Nil(err)
+	assert.Equal(len(keys), n)
+	for i, conn := range conns {
+		for _, write := range conn.Writes() {
+			for _, line := range splitLines(write) {
+				assert.NotEqual(down, i)
+				if owner[line] != down {
+					assert.Equal(owner[line], i)
+				}
+			}
+		}
+	}
+}
+
+func TestBalanceAllDown(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := newBalancingAdapter(BalanceFailover, addressTransport{}, "one", "two")
+	assert.NotNil(adapter.dialAll())
+
+	n, err := adapter.writeBatch(keyedEvents("a"))
+	assert.Equal(0, n)
+	assert.NotNil(err)
+}
+
+func splitLines(write string) []string {
+	return strings.Split(strings.TrimSuffix(write, "\n"), "\n")
+}
@@ -0,0 +1,184 @@
+package logstash
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for the send pipeline, overridable with route options or
+// environment variables.
+const (
+	DefaultQueueSize     = 1024
+	DefaultBatchSize     = 100
+	DefaultBatchBytes    = 256 * 1024
+	DefaultFlushInterval = 500 * time.Millisecond
+	DefaultWriteTimeout  = 10 * time.Second
+)
+
+// event is an encoded log event waiting to be written.
+type event struct {
+	key  string // container ID, used to pick an endpoint
+	data []byte
+}
+
+// getoptInt is getopt for non-negative integer options.
+func getoptInt(route *router.Route, opt, env string, dfault int) (int, error) {
+	value := getopt(route, opt, env, "")
+	if value == "" {
+		return dfault, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid value for " + opt + ": " + value)
+	}
+	return n, nil
+}
+
+// getoptDuration is getopt for positive duration options such as "500ms".
+func getoptDuration(route *router.Route, opt, env string, dfault time.Duration) (time.Duration, error) {
+	value := getopt(route, opt, env, "")
+	if value == "" {
+		return dfault, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, errors.New("invalid value for " + opt + ": " + value)
+	}
+	return d, nil
+}
+
+// configureBatching reads the send pipeline settings for the adapter's route.
+// A queue size of zero disables the pipeline and writes every event
+// synchronously from Stream.
+func (a *LogstashAdapter) configureBatching() error {
+	var err error
+	if a.queueSize, err = getoptInt(a.route, "queue_size", "LOGSTASH_QUEUE_SIZE", DefaultQueueSize); err != nil {
+		return err
+	}
+	if a.batchSize, err = getoptInt(a.route, "batch_size", "LOGSTASH_BATCH_SIZE", DefaultBatchSize); err != nil {
+		return err
+	}
+	if a.batchBytes, err = getoptInt(a.route, "batch_bytes", "LOGSTASH_BATCH_BYTES", DefaultBatchBytes); err != nil {
+		return err
+	}
+	if a.flushInterval, err = getoptDuration(a.route, "flush_interval", "LOGSTASH_FLUSH_INTERVAL", DefaultFlushInterval); err != nil {
+		return err
+	}
+	if a.writeTimeout, err = getoptDuration(a.route, "write_timeout", "LOGSTASH_WRITE_TIMEOUT", DefaultWriteTimeout); err != nil {
+		return err
+	}
+	return nil
+}
+
+// isDatagram reports whether the route's transport preserves message
+// boundaries, in which case every event must be written on its own.
+func (a *LogstashAdapter) isDatagram() bool {
+	return a.route.AdapterTransport("udp") == "udp"
+}
+
+// startWriter starts the background writer if the pipeline is enabled.
+func (a *LogstashAdapter) startWriter() {
+	if a.queueSize == 0 {
+		return
+	}
+	if a.batchSize == 0 {
+		a.batchSize = 1
+	}
+	if a.flushInterval == 0 {
+		a.flushInterval = DefaultFlushInterval
+	}
+	a.queue = make(chan event, a.queueSize)
+	a.done = make(chan struct{})
+	go a.writer()
+}
+
+// stopWriter flushes everything still queued, waits for the writer to exit
+// and closes the backlog.
+func (a *LogstashAdapter) stopWriter() {
+	if a.queue != nil {
+		close(a.queue)
+		<-a.done
+		a.queue = nil
+	}
+	if a.backlog != nil {
+		if err := a.backlog.Close(); err != nil {
+			a.log.warnf("could not close backlog: %s", err)
+		}
+	}
+}
+
+// send hands an encoded event to the writer, blocking while the queue is
+// full. Without a pipeline the event is written straight away.
+func (a *LogstashAdapter) send(ev event) {
+	if a.queue == nil {
+		a.flush([]event{ev})
+		return
+	}
+	a.queue <- ev
+}
+
+// writer collects queued events into batches and flushes them when the batch
+// is full by count or bytes, or at least every flush interval.
+func (a *LogstashAdapter) writer() {
+	defer close(a.done)
+
+	ticker := time.NewTicker(a.flushInterval)
+	defer ticker.Stop()
+
+	var batch []event
+	size := 0
+
+	flush := func() {
+		if len(batch) > 0 {
+			a.flush(batch)
+			batch, size = nil, 0
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-a.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, ev)
+			size += len(ev.data)
+			if len(batch) >= a.batchSize || (a.batchBytes > 0 && size >= a.batchBytes) {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			a.replay()
+		}
+	}
+}
+
+// flush delivers a batch of newline-terminated events. Events that can't be
+// written, and everything after them until the backlog has been replayed, go
+// to the backlog instead so they're delivered in order once Logstash is
+// reachable again.
+func (a *LogstashAdapter) flush(batch []event) {
+	if a.backlog == nil {
+		a.backlog = newMemoryBacklog(DefaultRetryBuffer)
+	}
+
+	if !a.backlog.empty() {
+		if err := a.backlog.append(batch); err != nil {
+			a.log.errorf("could not keep events for retrying: %s", err)
+		}
+		a.replay()
+		return
+	}
+
+	n, err := a.writeBatch(batch)
+	if err == nil {
+		return
+	}
+	if err := a.backlog.append(batch[n:]); err != nil {
+		a.log.errorf("could not keep events for retrying: %s", err)
+	}
+}
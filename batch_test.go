@@ -0,0 +1,222 @@
+package logstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingConn keeps a copy of every successful write, and fails writes
+// while err is set.
+type recordingConn struct {
+	MockConn
+	mu     sync.Mutex
+	writes []string
+	err    error
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.writes = append(c.writes, string(b))
+	return len(b), nil
+}
+
+func (c *recordingConn) SetError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+func (c *recordingConn) Writes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.writes...)
+}
+
+func newBatchingAdapter(adapterType string, conn *recordingConn) *LogstashAdapter {
+	return &LogstashAdapter{
+		route:         &router.Route{Adapter: adapterType},
+		endpoints:     []*endpoint{{address: "logstash:5000", conn: conn}},
+		client:        &MockClient{},
+		queueSize:     10,
+		batchSize:     3,
+		flushInterval: time.Hour,
+	}
+}
+
+func newRoute(options map[string]string) *router.Route {
+	return &router.Route{Options: options}
+}
+
+// sourcedLine is a log line and the stream it was written to.
+type sourcedLine struct {
+	source, data string
+}
+
+// stdoutLines returns lines written to stdout.
+func stdoutLines(lines ...string) []sourcedLine {
+	var result []sourcedLine
+	for _, line := range lines {
+		result = append(result, sourcedLine{"stdout", line})
+	}
+	return result
+}
+
+// streamSourcedLines streams lines of a container through the adapter, and
+// returns once they have all been sent.
+func streamSourcedLines(adapter *LogstashAdapter, container *docker.Container, lines ...sourcedLine) {
+	logstream := make(chan *router.Message)
+	go func() {
+		for _, line := range lines {
+			logstream <- &router.Message{Container: container, Source: line.source, Data: line.data, Time: time.Now()}
+		}
+		close(logstream)
+	}()
+	adapter.Stream(logstream)
+}
+
+// streamLines streams lines written to stdout by a container named name.
+func streamLines(adapter *LogstashAdapter, lines ...string) {
+	container := &docker.Container{
+		Name:   "name",
+		ID:     "ID",
+		Config: &docker.Config{Image: "image", Hostname: "hostname"},
+	}
+	streamSourcedLines(adapter, container, stdoutLines(lines...)...)
+}
+
+func messages(t *testing.T, write string) []string {
+	var result []string
+	for _, line := range strings.SplitAfter(write, "\n") {
+		if line == "" {
+			continue
+		}
+		var data map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(line), &data))
+		assert.True(t, strings.HasSuffix(line, "\n"))
+		result = append(result, data["message"].(string))
+	}
+	return result
+}
+
+func TestBatchingPacksStreamWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	streamLines(newBatchingAdapter("logstash+tcp", conn), "one", "two", "three", "four")
+
+	writes := conn.Writes()
+	assert.Len(writes, 2)
+	assert.Equal([]string{"one", "two", "three"}, messages(t, writes[0]))
+	assert.Equal([]string{"four"}, messages(t, writes[1]))
+}
+
+func TestBatchingWritesDatagramsSeparately(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	streamLines(newBatchingAdapter("logstash", conn), "one", "two", "three", "four")
+
+	writes := conn.Writes()
+	assert.Len(writes, 4)
+	for i, expected := range []string{"one", "two", "three", "four"} {
+		assert.Equal([]string{expected}, messages(t, writes[i]))
+	}
+}
+
+func TestBatchingFlushesByBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.batchSize = 100
+	adapter.batchBytes = 1
+	streamLines(adapter, "one", "two")
+
+	assert.Len(conn.Writes(), 2)
+}
+
+func TestBatchingFlushesByAge(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.batchSize = 100
+	adapter.flushInterval = 10 * time.Millisecond
+	adapter.startWriter()
+
+	adapter.send(event{key: "ID", data: []byte("{\"message\":\"one\"}\n")})
+	assert.Eventually(func() bool { return len(conn.Writes()) == 1 }, time.Second, 5*time.Millisecond)
+
+	adapter.stopWriter()
+	assert.Len(conn.Writes(), 1)
+}
+
+func TestBatchingOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: &router.Route{Options: map[string]string{
+		"queue_size":     "5",
+		"batch_size":     "2",
+		"flush_interval": "2s",
+	}}}
+	assert.Nil(adapter.configureBatching())
+	assert.Equal(5, adapter.queueSize)
+	assert.Equal(2, adapter.batchSize)
+	assert.Equal(DefaultBatchBytes, adapter.batchBytes)
+	assert.Equal(2*time.Second, adapter.flushInterval)
+
+	adapter.route.Options["batch_size"] = "lots"
+	assert.NotNil(adapter.configureBatching())
+}
+
+func TestWriteTimeoutWhenLogstashStopsReading(t *testing.T) {
+	assert := assert.New(t)
+
+	// Logstash accepts the connection but never reads from it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(err)
+	defer conn.Close()
+	server, err := l.Accept()
+	assert.Nil(err)
+	defer server.Close()
+
+	adapter := newBatchingAdapter("logstash+tcp", nil)
+	adapter.endpoints = []*endpoint{{address: l.Addr().String(), conn: conn}}
+	adapter.transport = &mockTransport{err: errors.New("connection refused")}
+	adapter.writeTimeout = 50 * time.Millisecond
+
+	// once the socket buffers are full, writes time out and the events go
+	// to the backlog rather than stalling the writer
+	data := append(bytes.Repeat([]byte("x"), 1<<20), '\n')
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 256 && (adapter.backlog == nil || adapter.backlog.empty()); i++ {
+			adapter.flush([]event{{key: "ID", data: data}})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes to a Logstash that doesn't read never timed out")
+	}
+	assert.False(adapter.backlog.empty())
+	assert.Nil(adapter.endpoints[0].conn)
+}
@@ -0,0 +1,136 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for the Lumberjack v2 protocol spoken to the Logstash beats input.
+const (
+	DefaultBeatsCompression = 3
+	DefaultBeatsTimeout     = 30 * time.Second
+)
+
+// Frame types of the Lumberjack v2 protocol.
+const (
+	beatsVersion    = '2'
+	beatsWindow     = 'W'
+	beatsCompressed = 'C'
+	beatsJSON       = 'J'
+	beatsAck        = 'A'
+)
+
+func init() {
+	router.AdapterTransports.Register(new(beatsTransport), "beats")
+}
+
+// beatsTransport dials the Logstash beats input, for logstash+beats:// routes.
+type beatsTransport struct{}
+
+// Dial connects to addr over TCP. The compression level and the time to wait
+// for acknowledgements are read from the beats_compression and beats_timeout
+// route options.
+func (t *beatsTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	route := &router.Route{Options: options}
+	level, err := getoptInt(route, "beats_compression", "LOGSTASH_BEATS_COMPRESSION", DefaultBeatsCompression)
+	if err != nil {
+		return nil, err
+	}
+	if level < zlib.NoCompression || level > zlib.BestCompression {
+		return nil, errors.New("invalid beats_compression: must be between 0 and 9")
+	}
+	timeout, err := getoptDuration(route, "beats_timeout", "LOGSTASH_BEATS_TIMEOUT", DefaultBeatsTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &beatsConn{Conn: conn, level: level, timeout: timeout}, nil
+}
+
+// beatsConn sends the newline separated events written to it as a window of
+// JSON frames, and only returns once Logstash acknowledged all of them, so a
+// failed write means the events must be sent again.
+type beatsConn struct {
+	net.Conn
+	level   int
+	timeout time.Duration
+}
+
+func (c *beatsConn) Write(p []byte) (int, error) {
+	var events [][]byte
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(line) > 0 {
+			events = append(events, line)
+		}
+	}
+	if len(events) == 0 {
+		return len(p), nil
+	}
+
+	var frames bytes.Buffer
+	for i, ev := range events {
+		frames.Write([]byte{beatsVersion, beatsJSON})
+		binary.Write(&frames, binary.BigEndian, uint32(i+1))
+		binary.Write(&frames, binary.BigEndian, uint32(len(ev)))
+		frames.Write(ev)
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{beatsVersion, beatsWindow})
+	binary.Write(&buf, binary.BigEndian, uint32(len(events)))
+	if c.level == zlib.NoCompression {
+		buf.Write(frames.Bytes())
+	} else {
+		var compressed bytes.Buffer
+		w, err := zlib.NewWriterLevel(&compressed, c.level)
+		if err != nil {
+			return 0, err
+		}
+		w.Write(frames.Bytes())
+		if err := w.Close(); err != nil {
+			return 0, err
+		}
+		buf.Write([]byte{beatsVersion, beatsCompressed})
+		binary.Write(&buf, binary.BigEndian, uint32(compressed.Len()))
+		buf.Write(compressed.Bytes())
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	if err := c.awaitAck(uint32(len(events))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// awaitAck reads acknowledgements until the one for the last event of the
+// window. Logstash acknowledges part of a window to show it is still busy,
+// and each of those gives it more time.
+func (c *beatsConn) awaitAck(last uint32) error {
+	var frame [6]byte
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		if _, err := io.ReadFull(c.Conn, frame[:]); err != nil {
+			return err
+		}
+		if frame[0] != beatsVersion || frame[1] != beatsAck {
+			return errors.New("unexpected beats frame: " + string(frame[:2]))
+		}
+		if binary.BigEndian.Uint32(frame[2:]) >= last {
+			return nil
+		}
+	}
+}
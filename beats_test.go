@@ -0,0 +1,239 @@
+package logstash
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+// lumberjackServer is a Lumberjack v2 server like the Logstash beats input.
+// It acknowledges each window once all its events arrived, unless told to
+// drop the connection instead.
+type lumberjackServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	events      []string // messages of acknowledged events
+	compressed  int      // windows that came compressed
+	dropWindows int      // windows to drop the connection on before acknowledging
+	keepalive   bool     // acknowledge 0 before each window is acknowledged
+}
+
+func newLumberjackServer(t *testing.T, dropWindows int, keepalive bool) *lumberjackServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &lumberjackServer{listener: listener, dropWindows: dropWindows, keepalive: keepalive}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *lumberjackServer) Close() {
+	s.listener.Close()
+}
+
+func (s *lumberjackServer) Events() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.events...)
+}
+
+func (s *lumberjackServer) Compressed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compressed
+}
+
+func (s *lumberjackServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var header [6]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return
+		}
+		if header[0] != beatsVersion || header[1] != beatsWindow {
+			return
+		}
+		size := int(binary.BigEndian.Uint32(header[2:]))
+
+		var window []string
+		for len(window) < size {
+			events, compressed, err := readLumberjackFrames(r)
+			if err != nil {
+				return
+			}
+			window = append(window, events...)
+			if compressed {
+				s.mu.Lock()
+				s.compressed++
+				s.mu.Unlock()
+			}
+		}
+
+		s.mu.Lock()
+		drop := s.dropWindows > 0
+		if drop {
+			s.dropWindows--
+		} else {
+			s.events = append(s.events, window...)
+		}
+		keepalive := s.keepalive
+		s.mu.Unlock()
+		if drop {
+			return
+		}
+
+		if keepalive {
+			conn.Write([]byte{beatsVersion, beatsAck, 0, 0, 0, 0})
+		}
+		ack := []byte{beatsVersion, beatsAck, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(ack[2:], uint32(size))
+		conn.Write(ack)
+	}
+}
+
+// readLumberjackFrames reads a JSON frame, or a compressed frame holding
+// several, and returns the messages of their events.
+func readLumberjackFrames(r io.Reader) ([]string, bool, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, false, err
+	}
+	switch header[1] {
+	case beatsCompressed:
+		var size uint32
+		binary.Read(r, binary.BigEndian, &size)
+		zr, err := zlib.NewReader(io.LimitReader(r, int64(size)))
+		if err != nil {
+			return nil, false, err
+		}
+		data, err := ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, false, err
+		}
+		var events []string
+		inner := bytes.NewReader(data)
+		for inner.Len() > 0 {
+			frames, _, err := readLumberjackFrames(inner)
+			if err != nil {
+				return nil, false, err
+			}
+			events = append(events, frames...)
+		}
+		return events, true, nil
+	case beatsJSON:
+		var seq, size uint32
+		binary.Read(r, binary.BigEndian, &seq)
+		binary.Read(r, binary.BigEndian, &size)
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, false, err
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(payload, &data); err != nil {
+			return nil, false, err
+		}
+		message, _ := data["message"].(string)
+		return []string{message}, false, nil
+	}
+	return nil, false, errors.New("unexpected frame " + string(header[:]))
+}
+
+func newBeatsAdapter(s *lumberjackServer, options map[string]string) *LogstashAdapter {
+	adapter := newBatchingAdapter("logstash+beats", nil)
+	adapter.route.Options = options
+	adapter.transport = new(beatsTransport)
+	adapter.endpoints = []*endpoint{{address: s.listener.Addr().String()}}
+	return adapter
+}
+
+func TestBeatsTransportRegistered(t *testing.T) {
+	transport, ok := router.AdapterTransports.Lookup((&router.Route{Adapter: "logstash+beats"}).AdapterTransport("udp"))
+	assert.True(t, ok)
+	assert.IsType(t, new(beatsTransport), transport)
+}
+
+func TestBeatsDeliversWindows(t *testing.T) {
+	for _, level := range []string{"0", "3"} {
+		s := newLumberjackServer(t, 0, true)
+		adapter := newBeatsAdapter(s, map[string]string{"beats_compression": level})
+		assert.Nil(t, adapter.dialAll())
+
+		streamLines(adapter, "one", "two", "three", "four")
+
+		assert.Equal(t, []string{"one", "two", "three", "four"}, s.Events(), level)
+		if level == "0" {
+			assert.Equal(t, 0, s.Compressed())
+		} else {
+			assert.Equal(t, 2, s.Compressed())
+		}
+		s.Close()
+	}
+}
+
+func TestBeatsResendsUnacknowledgedWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newLumberjackServer(t, 1, false)
+	defer s.Close()
+	adapter := newBeatsAdapter(s, map[string]string{"beats_timeout": "1s"})
+	adapter.backoffMin = time.Millisecond
+	adapter.backoffMax = time.Millisecond
+	assert.Nil(adapter.dialAll())
+
+	batch := []event{{key: "ID", data: []byte(`{"message":"a"}` + "\n")}, {key: "ID", data: []byte(`{"message":"b"}` + "\n")}}
+	n, err := adapter.writeBatch(batch)
+	assert.NotNil(err)
+	assert.Equal(0, n)
+	assert.Nil(adapter.endpoints[0].conn)
+
+	time.Sleep(5 * time.Millisecond)
+	n, err = adapter.writeBatch(batch)
+	assert.Nil(err)
+	assert.Equal(2, n)
+	assert.Equal([]string{"a", "b"}, s.Events())
+}
+
+func TestBeatsTimesOutWithoutAck(t *testing.T) {
+	assert := assert.New(t)
+
+	// a server that reads but never acknowledges
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conn, err := new(beatsTransport).Dial(listener.Addr().String(), map[string]string{"beats_timeout": "50ms"})
+	assert.Nil(err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("{\"message\":\"a\"}\n"))
+	assert.NotNil(err)
+
+	_, err = new(beatsTransport).Dial(listener.Addr().String(), map[string]string{"beats_compression": "10"})
+	assert.NotNil(err)
+}
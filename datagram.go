@@ -0,0 +1,123 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// DefaultUDPMaxSize is the largest UDP payload IPv4 can carry.
+const DefaultUDPMaxSize = 65507
+
+// What to do with events too large for a datagram.
+const (
+	// OversizeTruncate shortens the longest text field of the event until
+	// it fits, tagging it "truncated".
+	OversizeTruncate = "truncate"
+	// OversizeGzip compresses the event with gzip, and truncates it if it
+	// is still too large.
+	OversizeGzip = "gzip"
+)
+
+// configureDatagram reads the largest datagram to send and what to do with
+// larger events.
+func (a *LogstashAdapter) configureDatagram() error {
+	var err error
+	if a.udpMaxSize, err = getoptInt(a.route, "udp_max_size", "LOGSTASH_UDP_MAX_SIZE", DefaultUDPMaxSize); err != nil {
+		return err
+	}
+	a.udpOversize = getopt(a.route, "udp_oversize", "LOGSTASH_UDP_OVERSIZE", OversizeTruncate)
+	switch a.udpOversize {
+	case OversizeTruncate, OversizeGzip:
+		return nil
+	}
+	return errors.New("unknown udp_oversize: " + a.udpOversize)
+}
+
+// fitDatagram makes an encoded event fit in a datagram, and returns false if
+// it can't. GELF events are left alone, as GELF has its own chunking, and so
+// are events on stream transports, which have no size limit.
+func (a *LogstashAdapter) fitDatagram(m *router.Message, data map[string]interface{}, js []byte) ([]byte, bool) {
+	max := a.udpMaxSize
+	if max == 0 {
+		max = DefaultUDPMaxSize
+	}
+	if len(js) <= max || a.format == FormatGELF || !a.isDatagram() {
+		return js, true
+	}
+	a.metrics.oversizedEvent()
+
+	if a.udpOversize == OversizeGzip {
+		if compressed := gzipEvent(js); len(compressed) <= max {
+			return compressed, true
+		}
+	}
+
+	key := longestText(data)
+	if key == "" {
+		a.log.with("container", m.Container.ID).warnf("dropping event of %d bytes, which has no text to truncate", len(js))
+		a.metrics.oversizeDropped()
+		return nil, false
+	}
+	tags, _ := data["tags"].([]string)
+	data["tags"] = append(append([]string(nil), tags...), "truncated")
+	data["original_length"] = len(js)
+
+	text := data[key].(string)
+	for {
+		var err error
+		if js, err = a.encode(m, data); err != nil {
+			return nil, false
+		}
+		if len(js) <= max {
+			return js, true
+		}
+		if text == "" {
+			a.log.with("container", m.Container.ID).warnf("dropping event of %d bytes, which doesn't fit even when truncated", data["original_length"])
+			a.metrics.oversizeDropped()
+			return nil, false
+		}
+		// escaping can make the text take more room encoded than it does
+		// itself, so keep its share of what fits and try again
+		encoded, _ := json.Marshal(text)
+		keep := len(encoded) - 2 - (len(js) - max)
+		if keep < 0 {
+			keep = 0
+		}
+		cut := len(text) * keep / (len(encoded) - 2)
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+		data[key] = text
+	}
+}
+
+// longestText returns the key of the longest text field of an event, or an
+// empty string if it has none.
+func longestText(data map[string]interface{}) string {
+	longest := ""
+	size := 0
+	for k, v := range data {
+		switch k {
+		case "@timestamp", "@version", "stream":
+			continue
+		}
+		if s, ok := v.(string); ok && (len(s) > size || (len(s) == size && k < longest)) {
+			longest, size = k, len(s)
+		}
+	}
+	return longest
+}
+
+func gzipEvent(js []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(js)
+	w.Close()
+	return buf.Bytes()
+}
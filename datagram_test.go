@@ -0,0 +1,92 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDatagramAdapter(adapterType string, conn *recordingConn, maxSize int) *LogstashAdapter {
+	adapter := newBatchingAdapter(adapterType, conn)
+	adapter.udpMaxSize = maxSize
+	adapter.udpOversize = OversizeTruncate
+	adapter.metrics = new(adapterMetrics)
+	return adapter
+}
+
+func TestDatagramTruncation(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newDatagramAdapter("logstash", conn, 400)
+	long := strings.Repeat(`"é"`, 200)
+	streamLines(adapter, "short", long, `{"blob": [`+strings.Repeat("1,", 300)+`1]}`)
+
+	writes := conn.Writes()
+	assert.Len(writes, 2)
+	assert.Equal("short", decodeGELF(t, []byte(writes[0]))["message"])
+
+	assert.True(len(writes[1]) <= 400)
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(writes[1]), &data))
+	message := data["message"].(string)
+	assert.True(strings.HasPrefix(long, message))
+	assert.True(utf8.ValidString(message))
+	assert.NotEmpty(message)
+	assert.Equal([]interface{}{"truncated"}, data["tags"])
+	assert.True(data["original_length"].(float64) > 400)
+
+	// the event without text to truncate is dropped
+	assert.Equal(uint64(2), adapter.metrics.oversized)
+	assert.Equal(uint64(1), adapter.metrics.oversizeDrops)
+}
+
+func TestDatagramGzip(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newDatagramAdapter("logstash", conn, 400)
+	adapter.udpOversize = OversizeGzip
+	long := strings.Repeat("compressible ", 100)
+	streamLines(adapter, long, "short")
+
+	writes := conn.Writes()
+	assert.Len(writes, 2)
+	r, err := gzip.NewReader(bytes.NewReader([]byte(writes[0])))
+	assert.Nil(err)
+	js, err := ioutil.ReadAll(r)
+	assert.Nil(err)
+	assert.Equal(long, decodeGELF(t, js)["message"])
+	assert.Equal("short", decodeGELF(t, []byte(writes[1]))["message"])
+}
+
+func TestDatagramLimitOnlyForUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newDatagramAdapter("logstash+tcp", conn, 100)
+	adapter.batchSize = 1
+	long := strings.Repeat("x", 500)
+	streamLines(adapter, long)
+
+	assert.Equal([]string{long}, messages(t, conn.Writes()[0]))
+	assert.Equal(uint64(0), adapter.metrics.oversized)
+}
+
+func TestConfigureDatagram(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{})}
+	assert.Nil(adapter.configureDatagram())
+	assert.Equal(DefaultUDPMaxSize, adapter.udpMaxSize)
+	assert.Equal(OversizeTruncate, adapter.udpOversize)
+
+	adapter.route.Options["udp_oversize"] = "split"
+	assert.NotNil(adapter.configureDatagram())
+}
@@ -0,0 +1,133 @@
+package logstash
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Layouts of the fields describing where an event came from.
+const (
+	// SchemaLegacy puts the container details under docker, with
+	// Kubernetes pod labels merged into docker.labels.
+	SchemaLegacy = "legacy"
+	// SchemaECS follows the Elastic Common Schema.
+	SchemaECS = "ecs"
+)
+
+// ECS_VERSION is the version of the Elastic Common Schema events follow.
+var ECS_VERSION = "8.11.0"
+
+var K8S_POD_NAME_LABEL = "io.kubernetes.pod.name"
+var K8S_POD_NAMESPACE_LABEL = "io.kubernetes.pod.namespace"
+var K8S_CONTAINER_NAME_LABEL = "io.kubernetes.container.name"
+
+// configureSchema reads the output schema for the adapter's route.
+func (a *LogstashAdapter) configureSchema() error {
+	a.schema = getopt(a.route, "schema", "LOGSTASH_SCHEMA", SchemaLegacy)
+	switch a.schema {
+	case SchemaLegacy, SchemaECS:
+		return nil
+	}
+	return errors.New("unknown schema: " + a.schema)
+}
+
+// GetECSFields returns the container, host and kubernetes fields of events
+// in the ECS schema. Labels are only included if DOCKER_LABELS is set, or if
+// they come from the Kubernetes API.
+func GetECSFields(c *docker.Container, a *LogstashAdapter) map[string]interface{} {
+	container := map[string]interface{}{
+		"id":    c.ID,
+		"name":  strings.TrimPrefix(c.Name, "/"),
+		"image": map[string]interface{}{"name": c.Config.Image},
+	}
+	fields := map[string]interface{}{
+		"container": container,
+		"ecs":       map[string]interface{}{"version": ECS_VERSION},
+	}
+
+	if host := GetDockerHost(a); host != "" {
+		fields["host"] = map[string]interface{}{"name": host}
+	}
+
+	withLabels := os.Getenv("DOCKER_LABELS") != ""
+	if withLabels {
+		container["labels"] = dedot(SelectContainerLabels(c.Config.Labels))
+	}
+
+	uid, ok := c.Config.Labels[K8S_POD_UID_LABEL]
+	if !ok {
+		return fields
+	}
+
+	pod := map[string]interface{}{"uid": uid}
+	kubernetes := map[string]interface{}{"pod": pod}
+	if name := c.Config.Labels[K8S_POD_NAME_LABEL]; name != "" {
+		pod["name"] = name
+	}
+	if namespace := c.Config.Labels[K8S_POD_NAMESPACE_LABEL]; namespace != "" {
+		kubernetes["namespace"] = namespace
+	}
+	if name := c.Config.Labels[K8S_CONTAINER_NAME_LABEL]; name != "" {
+		kubernetes["container"] = map[string]interface{}{"name": name}
+	}
+	if withLabels {
+		labels, err := GetPodSandboxLabels(c, a)
+		if err != nil {
+			a.log.with("container", c.ID).warnf("could not get pod labels: %s", err)
+		} else if labels != nil {
+			kubernetes["labels"] = dedot(labels)
+		}
+	}
+	for k, v := range GetKubernetesFields(c, a) {
+		kubernetes[k] = v
+	}
+	fields["kubernetes"] = kubernetes
+
+	return fields
+}
+
+// GetPodSandboxLabels returns the labels of the Kubernetes pod that c belongs
+// to, taken from its pause container.
+func GetPodSandboxLabels(c *docker.Container, a *LogstashAdapter) (map[string]string, error) {
+	if a.client == nil {
+		return nil, nil
+	}
+
+	labels, err := a.metadata().get(c.ID, "podLabels", func() (interface{}, error) {
+		sandbox, err := findPodSandbox(c, a)
+		if err != nil {
+			return nil, err
+		}
+
+		var labels map[string]string
+		if sandbox != nil {
+			labels = SelectContainerLabels(sandbox.Labels)
+		}
+		return labels, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return labels.(map[string]string), nil
+}
+
+// GetDockerHost returns the name of the Docker host, looked up once.
+func GetDockerHost(a *LogstashAdapter) string {
+	if a.client == nil {
+		return ""
+	}
+	return GetDockerLabels(a)["host"]
+}
+
+// dedot replaces dots in label names with underscores, so Elasticsearch
+// doesn't turn them into nested objects.
+func dedot(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[strings.Replace(k, ".", "_", -1)] = v
+	}
+	return result
+}
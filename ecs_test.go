@@ -0,0 +1,133 @@
+package logstash
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamECSSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.Setenv("DOCKER_LABELS", os.Getenv("DOCKER_LABELS"))
+	os.Setenv("DOCKER_LABELS", "1")
+
+	client := MockClient{}
+	client.CreateContainer(docker.CreateContainerOptions{
+		Name: "podParent",
+		Config: &docker.Config{Labels: map[string]string{
+			"io.kubernetes.pod.uid":     "POD-UUID",
+			"io.kubernetes.docker.type": "podsandbox",
+			"app":                       "myapp",
+			"app.kubernetes.io/version": "1.2",
+		}},
+	})
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.client = &client
+	adapter.schema = SchemaECS
+
+	container := multilineContainer(map[string]string{
+		"io.kubernetes.pod.uid":        "POD-UUID",
+		"io.kubernetes.pod.name":       "myapp-1234",
+		"io.kubernetes.pod.namespace":  "default",
+		"io.kubernetes.container.name": "web",
+		"io.kubernetes.docker.type":    "container",
+		"com.example.team":             "logging",
+	})
+	container.Name = "/k8s_web_myapp-1234"
+	streamSourcedLines(adapter, container, stdoutLines(`{"message": "hello", "host": "overwritten"}`)...)
+
+	writes := conn.Writes()
+	assert.Len(writes, 1)
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(writes[0]), &data))
+
+	assert.Equal("hello", data["message"])
+	assert.Equal("stdout", data["stream"])
+	assert.NotNil(data["@timestamp"])
+	assert.Nil(data["docker"])
+	assert.Equal(map[string]interface{}{"version": ECS_VERSION}, data["ecs"])
+	assert.Equal(map[string]interface{}{"name": "banana-potato"}, data["host"])
+	assert.Equal(map[string]interface{}{
+		"id":     "ID",
+		"name":   "k8s_web_myapp-1234",
+		"image":  map[string]interface{}{"name": "image"},
+		"labels": map[string]interface{}{"com_example_team": "logging"},
+	}, data["container"])
+	assert.Equal(map[string]interface{}{
+		"namespace": "default",
+		"pod":       map[string]interface{}{"uid": "POD-UUID", "name": "myapp-1234"},
+		"container": map[string]interface{}{"name": "web"},
+		"labels":    map[string]interface{}{"app": "myapp", "app_kubernetes_io/version": "1.2"},
+	}, data["kubernetes"])
+}
+
+func TestStreamECSSchemaWithoutLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	defer os.Setenv("DOCKER_LABELS", os.Getenv("DOCKER_LABELS"))
+	os.Setenv("DOCKER_LABELS", "")
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.schema = SchemaECS
+
+	streamSourcedLines(adapter, multilineContainer(map[string]string{"a.label": "value"}), stdoutLines("plain")...)
+
+	writes := conn.Writes()
+	assert.Len(writes, 1)
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(writes[0]), &data))
+
+	assert.Equal("plain", data["message"])
+	assert.Equal(map[string]interface{}{
+		"id":    "ID",
+		"name":  "name",
+		"image": map[string]interface{}{"name": "image"},
+	}, data["container"])
+	assert.Equal(map[string]interface{}{"name": "banana-potato"}, data["host"])
+	assert.Nil(data["kubernetes"])
+}
+
+func TestStreamECSSchemaMergesLogFields(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.schema = SchemaECS
+	adapter.levels = defaultLevels
+
+	container := multilineContainer(map[string]string{"logstash.fields": "log.logger=web,service.name=shop"})
+	streamSourcedLines(adapter, container, stdoutLines(`{"message": "slow", "level": "WARNING", "log": {"origin": {"function": "main"}}}`)...)
+
+	writes := conn.Writes()
+	assert.Len(writes, 1)
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(writes[0]), &data))
+	assert.Equal(map[string]interface{}{
+		"level":  "warn",
+		"logger": "web",
+		"origin": map[string]interface{}{"function": "main"},
+	}, data["log"])
+	assert.Equal(map[string]interface{}{"name": "shop"}, data["service"])
+}
+
+func TestConfigureSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{})}
+	assert.Nil(adapter.configureSchema())
+	assert.Equal(SchemaLegacy, adapter.schema)
+
+	adapter.route.Options["schema"] = "ecs"
+	assert.Nil(adapter.configureSchema())
+	assert.Equal(SchemaECS, adapter.schema)
+
+	adapter.route.Options["schema"] = "gelf"
+	assert.NotNil(adapter.configureSchema())
+}
@@ -0,0 +1,349 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for sending events straight to the Elasticsearch bulk API.
+const (
+	DefaultElasticsearchIndex   = "logspout-%Y.%m.%d"
+	DefaultElasticsearchRetries = 3
+	DefaultElasticsearchTimeout = 30 * time.Second
+)
+
+// How long to wait before resending rejected items the first time.
+var elasticsearchRetryBackoff = 500 * time.Millisecond
+
+func init() {
+	router.AdapterTransports.Register(new(elasticsearchTransport), "elasticsearch")
+}
+
+// elasticsearchTransport sends events to the bulk API of Elasticsearch, for
+// logstash+elasticsearch:// routes.
+type elasticsearchTransport struct{}
+
+// Dial returns a connection that posts what is written to it to the bulk API
+// at addr. Nothing is sent until the first write.
+func (t *elasticsearchTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	route := &router.Route{Options: options}
+	c := &elasticsearchConn{
+		index:    getopt(route, "es_index", "LOGSTASH_ES_INDEX", DefaultElasticsearchIndex),
+		username: getopt(route, "es_username", "LOGSTASH_ES_USERNAME", ""),
+		password: getopt(route, "es_password", "LOGSTASH_ES_PASSWORD", ""),
+		apiKey:   getopt(route, "es_api_key", "LOGSTASH_ES_API_KEY", ""),
+		address:  addr,
+	}
+	c.log, _ = newLogger(route)
+	c.log = c.log.with("destination", addr)
+
+	scheme := getopt(route, "es_scheme", "LOGSTASH_ES_SCHEME", "http")
+	if scheme != "http" && scheme != "https" {
+		return nil, errors.New("unknown es_scheme: " + scheme)
+	}
+	c.url = scheme + "://" + addr + "/_bulk"
+
+	var err error
+	if c.gzip, err = strconv.ParseBool(getopt(route, "es_gzip", "LOGSTASH_ES_GZIP", "false")); err != nil {
+		return nil, errors.New("invalid es_gzip: " + err.Error())
+	}
+	if c.retries, err = getoptInt(route, "es_retries", "LOGSTASH_ES_RETRIES", DefaultElasticsearchRetries); err != nil {
+		return nil, err
+	}
+	timeout, err := getoptDuration(route, "es_timeout", "LOGSTASH_ES_TIMEOUT", DefaultElasticsearchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if scheme == "https" && getopt(route, "es_tls_skip_verify", "LOGSTASH_ES_TLS_SKIP_VERIFY", "") == "true" {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	c.client = &http.Client{Transport: transport, Timeout: timeout}
+	return c, nil
+}
+
+// elasticsearchConn indexes the newline separated events written to it with
+// one bulk request. Items Elasticsearch rejects because it is overloaded are
+// sent again on their own; items it can never accept are dropped. Requests
+// it refuses fail the write, so the events are kept. Each event gets an _id derived from its content, so events sent
+// again after a failed write aren't indexed twice.
+type elasticsearchConn struct {
+	url      string
+	address  string
+	index    string
+	username string
+	password string
+	apiKey   string
+	gzip     bool
+	retries  int
+	client   *http.Client
+	log      *logger
+}
+
+// bulkItem is an event and the action line that indexes it.
+type bulkItem struct {
+	action []byte
+	doc    []byte
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Index  string          `json:"_index"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (c *elasticsearchConn) Write(p []byte) (int, error) {
+	var items []bulkItem
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(line, &doc); err != nil {
+			c.log.warnf("dropping event that isn't JSON: %s", err)
+			continue
+		}
+		action, _ := json.Marshal(map[string]interface{}{
+			"create": map[string]string{"_index": indexName(c.index, doc), "_id": documentID(line)},
+		})
+		items = append(items, bulkItem{action: action, doc: line})
+	}
+
+	backoff := elasticsearchRetryBackoff
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > c.retries {
+				return 0, fmt.Errorf("elasticsearch rejected %d events %d times", len(items), attempt)
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var err error
+		if items, err = c.bulk(items); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// bulk sends items in one bulk request and returns the ones that should be
+// sent again.
+func (c *elasticsearchConn) bulk(items []bulkItem) ([]bulkItem, error) {
+	var body bytes.Buffer
+	var w io.Writer = &body
+	var zw *gzip.Writer
+	if c.gzip {
+		zw = gzip.NewWriter(&body)
+		w = zw
+	}
+	for _, item := range items {
+		w.Write(item.action)
+		w.Write([]byte("\n"))
+		w.Write(item.doc)
+		w.Write([]byte("\n"))
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest("POST", c.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if c.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return items, nil
+	case resp.StatusCode == http.StatusRequestEntityTooLarge && len(items) > 1:
+		// send each half on its own, until the events that fit get through
+		first, err := c.bulk(items[:len(items)/2])
+		if err != nil {
+			return nil, err
+		}
+		second, err := c.bulk(items[len(items)/2:])
+		if err != nil {
+			return nil, err
+		}
+		return append(first, second...), nil
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		// an event too large to index on its own never will be
+		c.log.errorf("dropping event of %d bytes, elasticsearch returned %s", len(items[0].doc), resp.Status)
+		return nil, nil
+	default:
+		// such as 401 or 404 from expired credentials or a wrong address,
+		// which are fixed without the events being lost
+		return nil, fmt.Errorf("elasticsearch returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, errors.New("invalid bulk response: " + err.Error())
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, fmt.Errorf("bulk response has %d items for %d events", len(result.Items), len(items))
+	}
+
+	var retry []bulkItem
+	for i, r := range result.Items {
+		for _, item := range r {
+			switch {
+			// a conflict means the event was indexed by an earlier write
+			case item.Status < 300 || item.Status == http.StatusConflict:
+			case item.Status == http.StatusTooManyRequests || item.Status >= 500:
+				retry = append(retry, items[i])
+			default:
+				c.log.warnf("elasticsearch rejected event for %s with status %d: %s", item.Index, item.Status, item.Error)
+			}
+		}
+	}
+	return retry, nil
+}
+
+// documentID returns the _id of an event, a hash of its JSON.
+func documentID(doc []byte) string {
+	h := fnv.New128a()
+	h.Write(doc)
+	return fmt.Sprintf("%032x", h.Sum(nil))
+}
+
+// indexName fills in the index template for a document. {name} is replaced
+// by the field of that dotted path, and %Y, %m, %d and %H by the date of
+// the event's @timestamp, in UTC. Index names must be lowercase.
+func indexName(template string, doc map[string]interface{}) string {
+	t := time.Now().UTC()
+	if s, ok := doc["@timestamp"].(string); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			t = parsed.UTC()
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(template); i++ {
+		switch {
+		case template[i] == '{':
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				b.WriteString(template[i:])
+				i = len(template)
+				continue
+			}
+			b.WriteString(fieldString(doc, template[i+1:i+end]))
+			i += end
+		case template[i] == '%' && i+1 < len(template):
+			i++
+			switch template[i] {
+			case 'Y':
+				fmt.Fprintf(&b, "%04d", t.Year())
+			case 'm':
+				fmt.Fprintf(&b, "%02d", int(t.Month()))
+			case 'd':
+				fmt.Fprintf(&b, "%02d", t.Day())
+			case 'H':
+				fmt.Fprintf(&b, "%02d", t.Hour())
+			default:
+				b.WriteByte('%')
+				if template[i] != '%' {
+					b.WriteByte(template[i])
+				}
+			}
+		default:
+			b.WriteByte(template[i])
+		}
+	}
+	return strings.ToLower(b.String())
+}
+
+// fieldString returns the value at a dotted path of a document as a string,
+// or an empty string if there's nothing there.
+func fieldString(doc map[string]interface{}, path string) string {
+	var value interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = m[key]; !ok {
+			return ""
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil, map[string]interface{}, []interface{}:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Read reports the end of the stream, as responses are read by Write.
+func (c *elasticsearchConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *elasticsearchConn) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+func (c *elasticsearchConn) LocalAddr() net.Addr {
+	return elasticsearchAddr("")
+}
+
+func (c *elasticsearchConn) RemoteAddr() net.Addr {
+	return elasticsearchAddr(c.address)
+}
+
+// Deadlines are replaced by the es_timeout of each request.
+func (c *elasticsearchConn) SetDeadline(t time.Time) error      { return nil }
+func (c *elasticsearchConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *elasticsearchConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type elasticsearchAddr string
+
+func (a elasticsearchAddr) Network() string { return "tcp" }
+func (a elasticsearchAddr) String() string  { return string(a) }
@@ -0,0 +1,245 @@
+package logstash
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeElasticsearch answers bulk requests, rejecting events whose message
+// is "busy" the first time with 429 and those whose message is "bad" with
+// 400, and keeps the messages it indexed. Events with an _id it has already
+// indexed conflict, and requests with more than maxItems events are too
+// large.
+type fakeElasticsearch struct {
+	mu       sync.Mutex
+	indexed  map[string][]string // messages by index
+	ids      map[string]bool
+	requests int
+	busy     bool
+	auth     string
+	gzipped  bool
+	maxItems int
+}
+
+func (f *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	if f.auth != "" && r.Header.Get("Authorization") != f.auth {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+		f.gzipped = true
+	}
+
+	var actions []map[string]map[string]string
+	var docs []map[string]interface{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var action map[string]map[string]string
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var doc map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+		actions = append(actions, action)
+		docs = append(docs, doc)
+	}
+	if f.maxItems > 0 && len(docs) > f.maxItems {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var items []map[string]bulkResponseItem
+	errors := false
+	for i, doc := range docs {
+		index, id := actions[i]["create"]["_index"], actions[i]["create"]["_id"]
+		message, _ := doc["message"].(string)
+		item := bulkResponseItem{Index: index, Status: 201}
+		switch {
+		case f.ids[id]:
+			item.Status = 409
+			item.Error = json.RawMessage(`{"type":"version_conflict_engine_exception"}`)
+		case message == "bad":
+			item.Status = 400
+			item.Error = json.RawMessage(`{"type":"mapper_parsing_exception"}`)
+		case message == "busy" && !f.busy:
+			f.busy = true
+			item.Status = 429
+			item.Error = json.RawMessage(`{"type":"es_rejected_execution_exception"}`)
+		default:
+			f.indexed[index] = append(f.indexed[index], message)
+			f.ids[id] = true
+		}
+		errors = errors || item.Status >= 300
+		items = append(items, map[string]bulkResponseItem{"create": item})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": errors, "items": items})
+}
+
+func newElasticsearchAdapter(t *testing.T, es *fakeElasticsearch, options map[string]string) (*LogstashAdapter, func()) {
+	server := httptest.NewServer(es)
+	es.indexed = make(map[string][]string)
+	es.ids = make(map[string]bool)
+	adapter := newBatchingAdapter("logstash+elasticsearch", nil)
+	adapter.route.Options = options
+	adapter.transport = new(elasticsearchTransport)
+	adapter.endpoints = []*endpoint{{address: strings.TrimPrefix(server.URL, "http://")}}
+	assert.Nil(t, adapter.dialAll())
+	return adapter, server.Close
+}
+
+func TestElasticsearchTransportRegistered(t *testing.T) {
+	transport, ok := router.AdapterTransports.Lookup((&router.Route{Adapter: "logstash+elasticsearch"}).AdapterTransport("udp"))
+	assert.True(t, ok)
+	assert.IsType(t, new(elasticsearchTransport), transport)
+}
+
+func TestElasticsearchBulk(t *testing.T) {
+	assert := assert.New(t)
+
+	es := &fakeElasticsearch{auth: "ApiKey c2VjcmV0"}
+	adapter, stop := newElasticsearchAdapter(t, es, map[string]string{
+		"es_index":   "logs-{docker.name}-%Y.%m",
+		"es_api_key": "c2VjcmV0",
+		"es_gzip":    "true",
+	})
+	defer stop()
+
+	streamLines(adapter, "one", "two", "three", "four")
+
+	index := "logs-name-" + time.Now().UTC().Format("2006.01")
+	assert.Equal(map[string][]string{index: {"one", "two", "three", "four"}}, es.indexed)
+	assert.Equal(2, es.requests)
+	assert.True(es.gzipped)
+}
+
+func TestElasticsearchRetriesRejectedItems(t *testing.T) {
+	assert := assert.New(t)
+
+	elasticsearchRetryBackoff = time.Millisecond
+	defer func() { elasticsearchRetryBackoff = 500 * time.Millisecond }()
+
+	es := &fakeElasticsearch{auth: "Basic dXNlcjpwYXNz"}
+	adapter, stop := newElasticsearchAdapter(t, es, map[string]string{
+		"es_username": "user",
+		"es_password": "pass",
+	})
+	defer stop()
+
+	streamLines(adapter, "busy", "bad", "fine")
+
+	// only the rejected item is sent again, and the one that can't be
+	// indexed is dropped
+	index := "logspout-" + time.Now().UTC().Format("2006.01.02")
+	assert.Equal(map[string][]string{index: {"fine", "busy"}}, es.indexed)
+	assert.Equal(2, es.requests)
+}
+
+func TestElasticsearchResendsWithoutDuplicates(t *testing.T) {
+	assert := assert.New(t)
+
+	es := &fakeElasticsearch{}
+	adapter, stop := newElasticsearchAdapter(t, es, map[string]string{"es_retries": "0"})
+	defer stop()
+
+	// the write fails as "busy" is still rejected when the retries run out,
+	// and sending it all again only indexes "busy"
+	lines := []byte(`{"message":"busy"}` + "\n" + `{"message":"fine"}` + "\n")
+	conn := adapter.endpoints[0].conn
+	_, err := conn.Write(lines)
+	assert.NotNil(err)
+	n, err := conn.Write(lines)
+	assert.Nil(err)
+	assert.Equal(len(lines), n)
+
+	index := "logspout-" + time.Now().UTC().Format("2006.01.02")
+	assert.Equal(map[string][]string{index: {"fine", "busy"}}, es.indexed)
+}
+
+func TestElasticsearchSplitsLargeRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	es := &fakeElasticsearch{maxItems: 2}
+	adapter, stop := newElasticsearchAdapter(t, es, nil)
+	defer stop()
+
+	lines := []byte(`{"message":"one"}` + "\n" + `{"message":"two"}` + "\n" + `{"message":"three"}` + "\n")
+	_, err := adapter.endpoints[0].conn.Write(lines)
+	assert.Nil(err)
+
+	index := "logspout-" + time.Now().UTC().Format("2006.01.02")
+	assert.Equal(map[string][]string{index: {"one", "two", "three"}}, es.indexed)
+	assert.Equal(3, es.requests)
+}
+
+func TestElasticsearchRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	es := &fakeElasticsearch{auth: "ApiKey right"}
+	adapter, stop := newElasticsearchAdapter(t, es, map[string]string{"es_api_key": "wrong"})
+
+	// refused requests fail the write, so the events are kept until the
+	// credentials are fixed
+	line := []byte(`{"message":"a"}` + "\n")
+	conn := adapter.endpoints[0].conn
+	n, err := adapter.writeBatch([]event{{key: "ID", data: line}})
+	assert.Equal(0, n)
+	assert.NotNil(err)
+	assert.Nil(adapter.endpoints[0].conn)
+	assert.Empty(es.indexed)
+
+	es.mu.Lock()
+	es.auth = "ApiKey wrong"
+	es.mu.Unlock()
+	n, err = conn.Write(line)
+	assert.Nil(err)
+	assert.Equal(len(line), n)
+	assert.Len(es.indexed, 1)
+
+	// as do requests that don't reach Elasticsearch
+	stop()
+	_, err = conn.Write(line)
+	assert.NotNil(err)
+
+	_, err = new(elasticsearchTransport).Dial("localhost:9200", map[string]string{"es_scheme": "ftp"})
+	assert.NotNil(err)
+}
+
+func TestIndexName(t *testing.T) {
+	assert := assert.New(t)
+
+	doc := map[string]interface{}{
+		"@timestamp": "2023-04-05T06:07:08.9Z",
+		"docker":     map[string]interface{}{"labels": map[string]interface{}{"app": "Web"}},
+		"status":     float64(200),
+	}
+	assert.Equal("logs-web-2023.04.05", indexName("logs-{docker.labels.app}-%Y.%m.%d", doc))
+	assert.Equal("logs-06-200-%", indexName("logs-%H-{status}-%%", doc))
+	assert.Equal("logs--", indexName("logs-{missing.field}-", doc))
+	assert.Equal("logs-{open", indexName("logs-{open", doc))
+}
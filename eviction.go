@@ -0,0 +1,98 @@
+package logstash
+
+import (
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Defaults for forgetting containers that weren't seen dying.
+const (
+	DefaultCacheTTL  = time.Hour
+	DefaultCacheSize = 10000
+)
+
+// How often Stream looks for containers that haven't logged for a while.
+var cacheSweepInterval = time.Minute
+
+// dockerEventBuffer is how many Docker events are held for Stream. The
+// Docker client drops events it can't hand over straight away, so bursts of
+// containers stopping need room.
+const dockerEventBuffer = 256
+
+// configureEviction reads how long the settings of a container are kept
+// after its last line, and for how many containers at most. Zero means no
+// limit.
+func (a *LogstashAdapter) configureEviction() error {
+	var err error
+	if a.cacheTTL, err = getoptDuration(a.route, "cache_ttl", "LOGSTASH_CACHE_TTL", DefaultCacheTTL); err != nil {
+		return err
+	}
+	if a.cacheSize, err = getoptInt(a.route, "cache_size", "LOGSTASH_CACHE_SIZE", DefaultCacheSize); err != nil {
+		return err
+	}
+	return nil
+}
+
+// watchContainers subscribes to Docker events, so containers are forgotten
+// when they die. The returned channel is nil if there's no Docker client or
+// the events can't be followed, and the returned function unsubscribes.
+func (a *LogstashAdapter) watchContainers() (chan *docker.APIEvents, func()) {
+	if a.client == nil {
+		return nil, func() {}
+	}
+	events := make(chan *docker.APIEvents, dockerEventBuffer)
+	if err := a.client.AddEventListener(events); err != nil {
+		a.log.warnf("cannot follow docker events, relying on cache_ttl: %s", err)
+		return nil, func() {}
+	}
+	return events, func() {
+		if err := a.client.RemoveEventListener(events); err != nil {
+			a.log.warnf("cannot stop following docker events: %s", err)
+		}
+	}
+}
+
+// eventsFull reports whether the events channel was full before the event
+// just received from it, in which case the Docker client may have dropped
+// the ones that followed.
+func eventsFull(events chan *docker.APIEvents) bool {
+	return len(events) >= cap(events)-1
+}
+
+// containerEvent sends the partly joined events of a container and forgets
+// it once it dies or is removed. Lines it wrote just before may still
+// arrive, and are looked up again.
+func (a *LogstashAdapter) containerEvent(ev *docker.APIEvents) {
+	// events of Docker before API 1.22 only have Status and ID
+	action, id := ev.Action, ev.Actor.ID
+	if action == "" {
+		action = ev.Status
+	}
+	if id == "" {
+		id = ev.ID
+	}
+	if ev.Type != "" && ev.Type != "container" {
+		return
+	}
+	switch action {
+	case "die", "destroy":
+		a.flushContainer(id)
+		a.forgetContainer(id)
+	}
+}
+
+// forgetContainer drops everything cached about a container.
+func (a *LogstashAdapter) forgetContainer(id string) {
+	a.log.with("container", id).debugf("forgetting container")
+	a.metadata().forget(id)
+}
+
+// sweepContainers forgets containers that haven't logged within the cache
+// TTL, and then the least recently seen ones beyond the cache size, in case
+// their events were missed.
+func (a *LogstashAdapter) sweepContainers(now time.Time) {
+	a.metadata().sweep(now, a.cacheTTL, a.cacheSize)
+	stats := a.metadata().Stats()
+	a.log.debugf("metadata cache: %d hits, %d misses, %d containers", stats.Hits, stats.Misses, stats.Containers)
+}
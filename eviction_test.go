@@ -0,0 +1,150 @@
+package logstash
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func cachedContainer(id string) *docker.Container {
+	return &docker.Container{
+		Name:   "name",
+		ID:     id,
+		Config: &docker.Config{Image: "image", Env: []string{"LOGSTASH_TAGS=one"}},
+	}
+}
+
+func cachedContainers(adapter *LogstashAdapter) []string {
+	var ids []string
+	for id := range adapter.metadata().containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestForgetContainerOnEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &MockClient{}
+	adapter := newBatchingAdapter("logstash+tcp", &recordingConn{})
+	adapter.client = client
+
+	logstream := make(chan *router.Message)
+	done := make(chan struct{})
+	go func() {
+		adapter.Stream(logstream)
+		close(done)
+	}()
+
+	for _, id := range []string{"dead", "removed", "stopped", "running"} {
+		logstream <- &router.Message{Container: cachedContainer(id), Source: "stdout", Data: "line", Time: time.Now()}
+	}
+	client.Emit(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "dead"}})
+	client.Emit(&docker.APIEvents{Status: "destroy", ID: "removed"})
+	client.Emit(&docker.APIEvents{Type: "container", Action: "stop", Actor: docker.APIActor{ID: "stopped"}})
+	client.Emit(&docker.APIEvents{Type: "network", Action: "destroy", Actor: docker.APIActor{ID: "running"}})
+	close(logstream)
+	<-done
+
+	assert.Equal([]string{"running", "stopped"}, cachedContainers(adapter))
+	assert.Empty(client.listeners)
+}
+
+func TestWatchContainersBuffered(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &MockClient{}
+	adapter := newBatchingAdapter("logstash+tcp", &recordingConn{})
+	adapter.client = client
+	events, unwatch := adapter.watchContainers()
+	defer unwatch()
+
+	// events sent while Stream is busy aren't dropped
+	for i := 0; i < 10; i++ {
+		client.Emit(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "dead"}})
+	}
+	assert.Len(events, 10)
+	assert.False(eventsFull(events))
+
+	for len(events) < cap(events) {
+		client.Emit(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "dead"}})
+	}
+	client.Emit(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "dropped"}})
+	<-events
+	assert.True(eventsFull(events))
+}
+
+func TestFlushContainerOnDie(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &MockClient{}
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	adapter.client = client
+	adapter.batchSize = 1
+
+	logstream := make(chan *router.Message)
+	done := make(chan struct{})
+	go func() {
+		adapter.Stream(logstream)
+		close(done)
+	}()
+
+	container := &docker.Container{ID: "dead", Name: "name", Config: &docker.Config{
+		Labels: map[string]string{"logstash.multiline.pattern": `^\s`},
+	}}
+	for _, line := range []string{"panic: oops", "  at main()"} {
+		logstream <- &router.Message{Container: container, Source: "stdout", Data: line, Time: time.Now()}
+	}
+	client.Emit(&docker.APIEvents{Type: "container", Action: "die", Actor: docker.APIActor{ID: "dead"}})
+
+	// the joined event is sent when the container dies, not when its
+	// multiline timeout passes
+	var writes []string
+	for deadline := time.Now().Add(time.Second); len(writes) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		writes = conn.Writes()
+	}
+	close(logstream)
+	<-done
+
+	assert.Len(writes, 1)
+	assert.Len(conn.Writes(), 1)
+	assert.Equal([]string{"panic: oops\n  at main()"}, messages(t, conn.Writes()[0]))
+	assert.Empty(cachedContainers(adapter))
+}
+
+func TestSweepContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := newBatchingAdapter("logstash+tcp", &recordingConn{})
+	adapter.cacheTTL = time.Hour
+	adapter.cacheSize = 2
+
+	now := time.Now()
+	for i, id := range []string{"old", "a", "b", "c"} {
+		GetContainerTags(cachedContainer(id), adapter)
+		adapter.cache.containers[id].used = now.Add(time.Duration(i) * time.Minute)
+	}
+	adapter.cache.containers["old"].used = now.Add(-2 * time.Hour)
+
+	// old is past the TTL, and a is the least recently seen of the rest
+	adapter.sweepContainers(now.Add(10 * time.Minute))
+	assert.Equal([]string{"b", "c"}, cachedContainers(adapter))
+}
+
+func TestConfigureEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{"cache_ttl": "10m"})}
+	assert.Nil(adapter.configureEviction())
+	assert.Equal(10*time.Minute, adapter.cacheTTL)
+	assert.Equal(DefaultCacheSize, adapter.cacheSize)
+
+	adapter.route.Options["cache_size"] = "many"
+	assert.NotNil(adapter.configureEviction())
+}
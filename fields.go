@@ -0,0 +1,188 @@
+package logstash
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseLogstashFields parses the comma separated key=value pairs of
+// LOGSTASH_FIELDS. Values may contain '=' and be double quoted to contain
+// commas too, and a backslash escapes the character after it anywhere. A
+// key may end in a type, as in count:int=3, of string (the default), int,
+// float or bool. Dotted keys such as service.name=api become nested objects;
+// an escaped dot doesn't.
+func ParseLogstashFields(s string) (map[string]interface{}, error) {
+	fields := make(map[string]interface{})
+	p := fieldsParser{s: s}
+	for !p.done() {
+		if p.s[p.i] == ',' {
+			// allow empty entries, like a trailing comma
+			p.i++
+			continue
+		}
+		path, typ, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		raw, err := p.value()
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", strings.Join(path, "."), err)
+		}
+		value, err := typedFieldValue(raw, typ)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", strings.Join(path, "."), err)
+		}
+		if err := setField(fields, path, value); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
+
+type fieldsParser struct {
+	s string
+	i int
+}
+
+func (p *fieldsParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+// key reads a key up to its '=', split at unescaped dots, and its type.
+func (p *fieldsParser) key() ([]string, string, error) {
+	var path []string
+	var part strings.Builder
+	typ := ""
+	typed := false
+	for {
+		if p.done() || p.s[p.i] == ',' {
+			return nil, "", fmt.Errorf("field %s has no value", strings.Join(append(path, part.String()), "."))
+		}
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '\\' && !p.done():
+			part.WriteByte(p.s[p.i])
+			p.i++
+			continue
+		case c == '=':
+			if typed {
+				typ = part.String()
+			} else {
+				path = append(path, part.String())
+			}
+			for _, k := range path {
+				if k == "" {
+					return nil, "", errors.New("empty field name in " + strings.Join(path, "."))
+				}
+			}
+			return path, typ, nil
+		case c == '.' && !typed:
+			path = append(path, part.String())
+			part.Reset()
+			continue
+		case c == ':' && !typed:
+			path = append(path, part.String())
+			part.Reset()
+			typed = true
+			continue
+		}
+		part.WriteByte(c)
+	}
+}
+
+// value reads a value up to the next unescaped comma outside quotes.
+func (p *fieldsParser) value() (string, error) {
+	var b strings.Builder
+	quoted := false
+	for !p.done() {
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '\\':
+			if p.done() {
+				return "", errors.New("unfinished escape")
+			}
+			b.WriteByte(p.s[p.i])
+			p.i++
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quoted {
+		return "", errors.New("unterminated quote")
+	}
+	return b.String(), nil
+}
+
+func typedFieldValue(raw, typ string) (interface{}, error) {
+	switch typ {
+	case "", "string":
+		return raw, nil
+	case "int":
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int %q", raw)
+		}
+		return n, nil
+	case "float":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid float %q", raw)
+		}
+		return f, nil
+	case "bool":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool %q", raw)
+		}
+		return b, nil
+	}
+	return nil, errors.New("unknown type " + typ)
+}
+
+// setField sets the value at path, creating the objects along it.
+func setField(fields map[string]interface{}, path []string, value interface{}) error {
+	for i, k := range path[:len(path)-1] {
+		inner, ok := fields[k].(map[string]interface{})
+		if !ok {
+			if _, exists := fields[k]; exists {
+				return fmt.Errorf("field %s is both a value and an object", strings.Join(path[:i+1], "."))
+			}
+			inner = make(map[string]interface{})
+			fields[k] = inner
+		}
+		fields = inner
+	}
+	last := path[len(path)-1]
+	if _, ok := fields[last].(map[string]interface{}); ok {
+		return fmt.Errorf("field %s is both a value and an object", strings.Join(path, "."))
+	}
+	fields[last] = value
+	return nil
+}
+
+// mergeFields adds configured fields to an event. Objects the event already
+// has are merged into rather than replaced, so a configured log.* field
+// keeps the log.level of the line. The configured objects aren't modified.
+func mergeFields(data, fields map[string]interface{}) {
+	for k, v := range fields {
+		inner, ok := v.(map[string]interface{})
+		if !ok {
+			data[k] = v
+			continue
+		}
+		existing, ok := data[k].(map[string]interface{})
+		if !ok {
+			existing = make(map[string]interface{}, len(inner))
+			data[k] = existing
+		}
+		mergeFields(existing, inner)
+	}
+}
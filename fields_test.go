@@ -0,0 +1,73 @@
+package logstash
+
+import (
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogstashFields(t *testing.T) {
+	assert := assert.New(t)
+
+	fields, err := ParseLogstashFields("")
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{}, fields)
+
+	fields, err = ParseLogstashFields(`myfield=something,url=http://x/?a=b,,quoted="a,b=c",escaped=x\,y\"z,`)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"myfield": "something",
+		"url":     "http://x/?a=b",
+		"quoted":  "a,b=c",
+		"escaped": `x,y"z`,
+	}, fields)
+
+	fields, err = ParseLogstashFields(`count:int=3,ratio:float=0.5,debug:bool=true,name:string=007`)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"count": int64(3),
+		"ratio": 0.5,
+		"debug": true,
+		"name":  "007",
+	}, fields)
+
+	fields, err = ParseLogstashFields(`service.name=api,service.port:int=80,k8s\.io=yes`)
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{
+		"service": map[string]interface{}{"name": "api", "port": int64(80)},
+		"k8s.io":  "yes",
+	}, fields)
+}
+
+func TestParseLogstashFieldsErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, s := range []string{
+		"foo",
+		"foo,bar=baz",
+		"=value",
+		"a..b=c",
+		`a="unterminated`,
+		`a=trailing\`,
+		"count:int=three",
+		"debug:bool=maybe",
+		"when:date=today",
+		"service=api,service.name=api",
+		"service.name=api,service=api",
+	} {
+		_, err := ParseLogstashFields(s)
+		assert.NotNil(err, s)
+	}
+}
+
+func TestGetLogstashFieldsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	container := &docker.Container{ID: "bad", Config: &docker.Config{Env: []string{"LOGSTASH_FIELDS=foo"}}}
+	assert.Equal(map[string]interface{}{}, GetLogstashFields(container, adapter))
+
+	container = &docker.Container{ID: "typed", Config: &docker.Config{Env: []string{"LOGSTASH_FIELDS=a.b:int=1"}}}
+	assert.Equal(map[string]interface{}{"a": map[string]interface{}{"b": int64(1)}}, GetLogstashFields(container, adapter))
+}
@@ -0,0 +1,120 @@
+package logstash
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// lineFilter decides which lines of a container are sent.
+type lineFilter struct {
+	disabled bool
+	streams  map[string]bool // nil for both
+	exclude  *regexp.Regexp
+}
+
+// filterCounters counts the lines dropped by each rule of the filters.
+type filterCounters struct {
+	disabled uint64
+	stream   uint64
+	excluded uint64
+}
+
+// FilterStats are the numbers of lines an adapter dropped because their
+// container was disabled, because of their stream, and because they matched
+// the exclude_lines pattern.
+type FilterStats struct {
+	Disabled uint64
+	Stream   uint64
+	Excluded uint64
+}
+
+// FilterStats returns the numbers of lines the adapter dropped so far.
+func (a *LogstashAdapter) FilterStats() FilterStats {
+	return FilterStats{
+		Disabled: atomic.LoadUint64(&a.filtered.disabled),
+		Stream:   atomic.LoadUint64(&a.filtered.stream),
+		Excluded: atomic.LoadUint64(&a.filtered.excluded),
+	}
+}
+
+// IsExcluded reports whether the logs of a container are left out, which
+// is configured with the labels logstash.enable=false or logstash.exclude,
+// or the environment variables LOGSTASH_ENABLE and LOGSTASH_EXCLUDE.
+func IsExcluded(c *docker.Container, a *LogstashAdapter) bool {
+	return getLineFilter(c, a).disabled
+}
+
+// getLineFilter returns the filter of a container's lines, which is looked
+// up once. Besides disabling the container, it is configured with the label
+// logstash.streams (stdout or stderr) and logstash.exclude_lines, a regular
+// expression of lines to drop, or LOGSTASH_STREAMS and LOGSTASH_EXCLUDE_LINES.
+func getLineFilter(c *docker.Container, a *LogstashAdapter) *lineFilter {
+	filter, _ := a.metadata().get(c.ID, "filter", func() (interface{}, error) {
+		filter, err := parseLineFilter(c, a)
+		if err != nil {
+			a.log.with("container", c.ID).warnf("not filtering lines: %s", err)
+		}
+		return filter, nil
+	})
+	return filter.(*lineFilter)
+}
+
+func parseLineFilter(c *docker.Container, a *LogstashAdapter) (*lineFilter, error) {
+	filter := &lineFilter{}
+	excluded, _ := lookupContainerSetting(c, a, "logstash.exclude", "LOGSTASH_EXCLUDE")
+	filter.disabled = (excluded != "" && excluded != "false") ||
+		containerSetting(c, a, "logstash.enable", "LOGSTASH_ENABLE") == "false"
+	if filter.disabled {
+		return filter, nil
+	}
+
+	if streams := containerSetting(c, a, "logstash.streams", "LOGSTASH_STREAMS"); streams != "" {
+		filter.streams = make(map[string]bool)
+		for _, stream := range strings.Split(streams, ",") {
+			stream = strings.TrimSpace(stream)
+			if stream != "stdout" && stream != "stderr" {
+				return &lineFilter{}, errors.New("unknown stream " + stream)
+			}
+			filter.streams[stream] = true
+		}
+	}
+
+	if pattern := containerSetting(c, a, "logstash.exclude_lines", "LOGSTASH_EXCLUDE_LINES"); pattern != "" {
+		exclude, err := regexp.Compile(pattern)
+		if err != nil {
+			return &lineFilter{}, err
+		}
+		filter.exclude = exclude
+	}
+	return filter, nil
+}
+
+// acceptMessage reports whether a message of a container should be sent, as
+// far as can be told before it is joined into lines.
+func (a *LogstashAdapter) acceptMessage(m *router.Message) bool {
+	filter := getLineFilter(m.Container, a)
+	if filter.disabled {
+		atomic.AddUint64(&a.filtered.disabled, 1)
+		return false
+	}
+	if filter.streams != nil && !filter.streams[m.Source] {
+		atomic.AddUint64(&a.filtered.stream, 1)
+		return false
+	}
+	return true
+}
+
+// acceptLine reports whether a joined line of a container should be sent.
+func (a *LogstashAdapter) acceptLine(m *router.Message, line string) bool {
+	filter := getLineFilter(m.Container, a)
+	if filter.exclude != nil && filter.exclude.MatchString(line) {
+		atomic.AddUint64(&a.filtered.excluded, 1)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package logstash
+
+import (
+	"os"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterDisabledContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	streamSourcedLines(adapter, &docker.Container{ID: "disabled", Config: &docker.Config{
+		Labels: map[string]string{"logstash.enable": "false"},
+	}}, stdoutLines("one", "two")...)
+	streamSourcedLines(adapter, &docker.Container{ID: "excluded", Config: &docker.Config{
+		Env: []string{"LOGSTASH_EXCLUDE=true"},
+	}}, stdoutLines("three")...)
+
+	assert.Empty(conn.Writes())
+	assert.Equal(FilterStats{Disabled: 3}, adapter.FilterStats())
+}
+
+func TestFilterOptIn(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("LOGSTASH_ENABLE", "false")
+	defer os.Unsetenv("LOGSTASH_ENABLE")
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.batchSize = 1
+	streamSourcedLines(adapter, &docker.Container{ID: "default", Config: &docker.Config{}}, stdoutLines("hidden")...)
+	streamSourcedLines(adapter, &docker.Container{ID: "enabled", Config: &docker.Config{
+		Labels: map[string]string{"logstash.enable": "true"},
+	}}, stdoutLines("shown")...)
+
+	assert.Equal([]string{"shown"}, messages(t, conn.Writes()[0]))
+	assert.Equal(FilterStats{Disabled: 1}, adapter.FilterStats())
+}
+
+func TestFilterStreamsAndLines(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.batchSize = 10
+	streamSourcedLines(adapter, &docker.Container{ID: "filtered", Config: &docker.Config{
+		Labels: map[string]string{
+			"logstash.streams":       "stdout",
+			"logstash.exclude_lines": `^GET /health`,
+		},
+	}},
+		sourcedLine{"stdout", "GET /"},
+		sourcedLine{"stderr", "error"},
+		sourcedLine{"stdout", "GET /healthz"},
+		sourcedLine{"stderr", "stderr"},
+		sourcedLine{"stdout", "POST /"})
+
+	var sent []string
+	for _, write := range conn.Writes() {
+		sent = append(sent, messages(t, write)...)
+	}
+	assert.Equal([]string{"GET /", "POST /"}, sent)
+	assert.Equal(FilterStats{Stream: 2, Excluded: 1}, adapter.FilterStats())
+}
+
+func TestFilterInvalidSettings(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	for _, labels := range []map[string]string{
+		{"logstash.streams": "stdin"},
+		{"logstash.exclude_lines": "("},
+	} {
+		container := &docker.Container{ID: labels["logstash.streams"], Config: &docker.Config{Labels: labels}}
+		filter := getLineFilter(container, adapter)
+		assert.False(filter.disabled)
+		assert.Nil(filter.streams)
+		assert.Nil(filter.exclude)
+	}
+}
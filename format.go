@@ -0,0 +1,135 @@
+package logstash
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Formats events can be written in.
+const (
+	// FormatJSON writes each event as a line of JSON, for the json and
+	// json_lines codecs of Logstash.
+	FormatJSON = "json"
+	// FormatGELF writes events as GELF 1.1 messages, for Graylog.
+	FormatGELF = "gelf"
+	// FormatSyslog writes events as RFC 5424 syslog messages.
+	FormatSyslog = "syslog"
+)
+
+// Syslog severities, as also used by GELF levels.
+const (
+	SeverityEmergency = iota
+	SeverityAlert
+	SeverityCritical
+	SeverityError
+	SeverityWarning
+	SeverityNotice
+	SeverityInformational
+	SeverityDebug
+)
+
+// severityNames maps the level names applications log with to severities.
+var severityNames = map[string]int{
+	"emerg":     SeverityEmergency,
+	"emergency": SeverityEmergency,
+	"panic":     SeverityEmergency,
+	"alert":     SeverityAlert,
+	"crit":      SeverityCritical,
+	"critical":  SeverityCritical,
+	"fatal":     SeverityCritical,
+	"err":       SeverityError,
+	"error":     SeverityError,
+	"warn":      SeverityWarning,
+	"warning":   SeverityWarning,
+	"notice":    SeverityNotice,
+	"info":      SeverityInformational,
+	"debug":     SeverityDebug,
+	"trace":     SeverityDebug,
+}
+
+// configureFormat reads the format events are written in.
+func (a *LogstashAdapter) configureFormat() error {
+	a.format = getopt(a.route, "format", "LOGSTASH_FORMAT", FormatJSON)
+	switch a.format {
+	case FormatJSON:
+		return nil
+	case FormatGELF:
+		return a.configureGELF()
+	case FormatSyslog:
+		return a.configureSyslog()
+	}
+	return errors.New("unknown format: " + a.format)
+}
+
+// encode renders an event in the adapter's format, framed for its transport.
+func (a *LogstashAdapter) encode(m *router.Message, data map[string]interface{}) ([]byte, error) {
+	switch a.format {
+	case FormatGELF:
+		return a.encodeGELF(m, data)
+	case FormatSyslog:
+		return a.encodeSyslog(m, data)
+	}
+
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	// To work with tls and tcp transports via json_lines codec
+	return append(js, '\n'), nil
+}
+
+// plainEvent returns a copy of an event in which the structs and typed maps
+// of the metadata are plain maps, like the fields decoded from the log line.
+func plainEvent(data map[string]interface{}) (map[string]interface{}, error) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(js, &event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// eventHost names the Docker host an event came from, or its container if
+// the host isn't known.
+func eventHost(m *router.Message, a *LogstashAdapter) string {
+	if host := GetDockerHost(a); host != "" {
+		return host
+	}
+	if m.Container.Config.Hostname != "" {
+		return m.Container.Config.Hostname
+	}
+	return m.Container.ID
+}
+
+// eventSeverity returns the syslog severity of an event, taken from its
+// level field, or its log.level in the ECS schema, if it has one, and
+// otherwise from the stream it was written to: errors for stderr, and
+// informational for stdout.
+func eventSeverity(data map[string]interface{}, stream string) int {
+	for _, key := range []string{"level", "log.level"} {
+		switch level := fieldValue(data, key).(type) {
+		case string:
+			if severity, ok := severityNames[strings.ToLower(level)]; ok {
+				return severity
+			}
+			if n, err := strconv.Atoi(level); err == nil && n >= SeverityEmergency && n <= SeverityDebug {
+				return n
+			}
+		case float64:
+			if n := int(level); float64(n) == level && n >= SeverityEmergency && n <= SeverityDebug {
+				return n
+			}
+		}
+	}
+	if stream == "stderr" {
+		return SeverityError
+	}
+	return SeverityInformational
+}
@@ -0,0 +1,192 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for GELF over UDP.
+const (
+	DefaultGELFCompression = "zlib"
+	DefaultGELFChunkSize   = 1420
+)
+
+// GELF allows a message to be split into at most this many chunks.
+const gelfMaxChunks = 128
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// gelfInvalidChars matches characters not allowed in GELF field names.
+var gelfInvalidChars = regexp.MustCompile(`[^\w.\-]`)
+
+// configureGELF reads how GELF messages are compressed and chunked on UDP.
+func (a *LogstashAdapter) configureGELF() error {
+	a.gelfCompression = getopt(a.route, "gelf_compression", "LOGSTASH_GELF_COMPRESSION", DefaultGELFCompression)
+	switch a.gelfCompression {
+	case "zlib", "gzip", "none":
+	default:
+		return errors.New("unknown gelf_compression: " + a.gelfCompression)
+	}
+	var err error
+	if a.gelfChunkSize, err = getoptInt(a.route, "gelf_chunk_size", "LOGSTASH_GELF_CHUNK_SIZE", DefaultGELFChunkSize); err != nil {
+		return err
+	}
+	if a.gelfChunkSize <= 12 {
+		return errors.New("gelf_chunk_size must be larger than the 12 byte chunk header")
+	}
+	return nil
+}
+
+// encodeGELF renders an event as a GELF 1.1 message. Its fields become
+// additional fields, with nested fields joined by underscores. On UDP the
+// message is compressed; on stream transports it is terminated by a null
+// byte, as Graylog expects.
+func (a *LogstashAdapter) encodeGELF(m *router.Message, data map[string]interface{}) ([]byte, error) {
+	event, err := plainEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	message, _ := event["message"].(string)
+	gelf := map[string]interface{}{
+		"version":       "1.1",
+		"host":          eventHost(m, a),
+		"short_message": message,
+		"level":         eventSeverity(event, m.Source),
+	}
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		gelf["short_message"] = message[:i]
+		gelf["full_message"] = message
+	}
+	if gelf["short_message"] == "" {
+		gelf["short_message"] = "-"
+	}
+	if ts, ok := event["@timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			gelf["timestamp"] = math.Round(float64(t.UnixNano())/1e6) / 1e3
+		}
+	}
+
+	for k, v := range event {
+		switch k {
+		case "message", "@timestamp", "@version", "level":
+			continue
+		}
+		flattenGELF(gelfInvalidChars.ReplaceAllString(k, "_"), v, gelf)
+	}
+
+	js, err := json.Marshal(gelf)
+	if err != nil {
+		return nil, err
+	}
+	if !a.isDatagram() {
+		return append(js, 0), nil
+	}
+	return compressGELF(js, a.gelfCompression)
+}
+
+// flattenGELF adds a value as additional fields named after key, one per
+// nested field. Lists are joined by commas, as GELF values must be strings
+// or numbers.
+func flattenGELF(key string, value interface{}, gelf map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			flattenGELF(key+"_"+gelfInvalidChars.ReplaceAllString(k, "_"), inner, gelf)
+		}
+		return
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				parts = append(parts, s)
+			} else if js, err := json.Marshal(item); err == nil {
+				parts = append(parts, string(js))
+			}
+		}
+		value = strings.Join(parts, ",")
+	case bool:
+		if v {
+			value = "true"
+		} else {
+			value = "false"
+		}
+	case nil:
+		return
+	}
+	// _id is reserved by Graylog
+	if key == "id" {
+		key = "id_"
+	}
+	gelf["_"+key] = value
+}
+
+func compressGELF(js []byte, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	default:
+		return js, nil
+	}
+	w.Write(js)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeGELFChunks writes a GELF message as one datagram, or as chunks of at
+// most the chunk size if it is larger. Messages needing more chunks than
+// GELF allows are dropped.
+func (a *LogstashAdapter) writeGELFChunks(e *endpoint, data []byte) error {
+	size := a.gelfChunkSize
+	if size == 0 {
+		size = DefaultGELFChunkSize
+	}
+	if len(data) <= size {
+		_, err := e.conn.Write(data)
+		return err
+	}
+
+	payload := size - 12
+	count := (len(data) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		a.log.warnf("dropping GELF message of %d bytes, which needs more than %d chunks", len(data), gelfMaxChunks)
+		return nil
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	chunk := make([]byte, 0, size)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payload
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk = append(chunk[:0], gelfChunkMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*payload:end]...)
+		if _, err := e.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
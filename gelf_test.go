@@ -0,0 +1,139 @@
+package logstash
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newGELFAdapter(adapterType string, conn *recordingConn) *LogstashAdapter {
+	adapter := newBatchingAdapter(adapterType, conn)
+	adapter.batchSize = 1
+	adapter.format = FormatGELF
+	adapter.gelfCompression = "zlib"
+	adapter.gelfChunkSize = DefaultGELFChunkSize
+	return adapter
+}
+
+func decodeGELF(t *testing.T, data []byte) map[string]interface{} {
+	var gelf map[string]interface{}
+	assert.Nil(t, json.Unmarshal(data, &gelf))
+	return gelf
+}
+
+func inflate(t *testing.T, data []byte) []byte {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	assert.Nil(t, err)
+	inflated, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	return inflated
+}
+
+func TestGELFOverTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	streamLines(newGELFAdapter("logstash+tcp", conn), `{"message": "boom\n  at main()", "level": "warn", "user": {"id": 7, "admin": true}}`)
+
+	writes := conn.Writes()
+	assert.Len(writes, 1)
+	assert.True(strings.HasSuffix(writes[0], "\x00"))
+	gelf := decodeGELF(t, []byte(strings.TrimSuffix(writes[0], "\x00")))
+
+	assert.Equal("1.1", gelf["version"])
+	assert.Equal("banana-potato", gelf["host"])
+	assert.Equal("boom", gelf["short_message"])
+	assert.Equal("boom\n  at main()", gelf["full_message"])
+	assert.Equal(float64(SeverityWarning), gelf["level"])
+	assert.IsType(float64(0), gelf["timestamp"])
+	assert.Equal("name", gelf["_docker_name"])
+	assert.Equal("ID", gelf["_docker_id"])
+	assert.Equal("stdout", gelf["_stream"])
+	assert.Equal(float64(7), gelf["_user_id"])
+	assert.Equal("true", gelf["_user_admin"])
+	assert.NotContains(gelf, "_message")
+	assert.NotContains(gelf, "_level")
+	assert.NotContains(gelf, "_docker_labels")
+}
+
+func TestGELFOverUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	streamLines(newGELFAdapter("logstash", conn), "plain")
+
+	writes := conn.Writes()
+	assert.Len(writes, 1)
+	gelf := decodeGELF(t, inflate(t, []byte(writes[0])))
+	assert.Equal("plain", gelf["short_message"])
+	assert.NotContains(gelf, "full_message")
+	assert.Equal(float64(SeverityInformational), gelf["level"])
+}
+
+func TestGELFChunks(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newGELFAdapter("logstash", conn)
+	adapter.gelfCompression = "none"
+	adapter.gelfChunkSize = 100
+	message := strings.Repeat("0123456789", 30)
+	streamLines(adapter, message)
+
+	writes := conn.Writes()
+	assert.True(len(writes) > 1)
+	var payload []byte
+	for i, write := range writes {
+		assert.True(len(write) <= 100)
+		assert.Equal([]byte{0x1e, 0x0f}, []byte(write[:2]))
+		assert.Equal(writes[0][2:10], write[2:10], "message id")
+		assert.Equal(byte(i), write[10])
+		assert.Equal(byte(len(writes)), write[11])
+		payload = append(payload, write[12:]...)
+	}
+	assert.Equal(message, decodeGELF(t, payload)["short_message"])
+
+	// messages needing more than 128 chunks are dropped
+	conn = &recordingConn{}
+	adapter = newGELFAdapter("logstash", conn)
+	adapter.gelfCompression = "none"
+	adapter.gelfChunkSize = 13
+	streamLines(adapter, message)
+	assert.Empty(conn.Writes())
+}
+
+func TestConfigureFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{})}
+	assert.Nil(adapter.configureFormat())
+	assert.Equal(FormatJSON, adapter.format)
+
+	adapter.route.Options["format"] = "gelf"
+	assert.Nil(adapter.configureFormat())
+	assert.Equal("zlib", adapter.gelfCompression)
+	assert.Equal(DefaultGELFChunkSize, adapter.gelfChunkSize)
+
+	adapter.route.Options["gelf_compression"] = "lz4"
+	assert.NotNil(adapter.configureFormat())
+
+	adapter.route.Options["format"] = "xml"
+	assert.NotNil(adapter.configureFormat())
+}
+
+func TestEventSeverity(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(SeverityInformational, eventSeverity(map[string]interface{}{}, "stdout"))
+	assert.Equal(SeverityError, eventSeverity(map[string]interface{}{}, "stderr"))
+	assert.Equal(SeverityDebug, eventSeverity(map[string]interface{}{"level": "DEBUG"}, "stderr"))
+	assert.Equal(SeverityCritical, eventSeverity(map[string]interface{}{"level": "fatal"}, "stdout"))
+	assert.Equal(SeverityNotice, eventSeverity(map[string]interface{}{"level": float64(5)}, "stdout"))
+	assert.Equal(SeverityError, eventSeverity(map[string]interface{}{"level": "3"}, "stdout"))
+	assert.Equal(SeverityError, eventSeverity(map[string]interface{}{"level": "verbose"}, "stderr"))
+}
@@ -0,0 +1,212 @@
+package logstash
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ParserGrok matches lines against the container's grok pattern.
+const ParserGrok = "grok"
+
+// GrokFailureTag is added to the tags of lines that don't match the grok
+// pattern of their container, as Logstash's grok filter does.
+const GrokFailureTag = "_grokparsefailure"
+
+// grokAliases are the patterns that can be used as %{NAME} in a grok
+// pattern. They are a subset of Logstash's grok-patterns, rewritten for Go's
+// regular expressions.
+var grokAliases = map[string]string{
+	"USERNAME":   `[a-zA-Z0-9._-]+`,
+	"USER":       `%{USERNAME}`,
+	"INT":        `(?:[+-]?[0-9]+)`,
+	"BASE10NUM":  `(?:[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+))`,
+	"NUMBER":     `(?:%{BASE10NUM})`,
+	"POSINT":     `\b(?:[1-9][0-9]*)\b`,
+	"NONNEGINT":  `\b(?:[0-9]+)\b`,
+	"WORD":       `\b\w+\b`,
+	"NOTSPACE":   `\S+`,
+	"SPACE":      `\s*`,
+	"DATA":       `.*?`,
+	"GREEDYDATA": `.*`,
+	"QUOTEDSTRING": `(?:"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|` +
+		"`(?:[^`\\\\]|\\\\.)*`)",
+	"QS":   `%{QUOTEDSTRING}`,
+	"UUID": `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+
+	"IPV4":     `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":     `(?:(?:[0-9A-Fa-f]{0,4}:){2,7}(?:%{IPV4}|[0-9A-Fa-f]{1,4})?(?:%[0-9A-Za-z]+)?)`,
+	"IP":       `(?:%{IPV6}|%{IPV4})`,
+	"HOSTNAME": `\b(?:[0-9A-Za-z][0-9A-Za-z-]{0,62})(?:\.(?:[0-9A-Za-z][0-9A-Za-z-]{0,62}))*\.?`,
+	"IPORHOST": `(?:%{IP}|%{HOSTNAME})`,
+	"HOSTPORT": `%{IPORHOST}:%{POSINT}`,
+
+	"PATH":         `(?:/[\w_%!$@:.,+~-]*)+`,
+	"URIPROTO":     `[A-Za-z][A-Za-z0-9+.-]+`,
+	"URIHOST":      `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":      `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_-]*)+`,
+	"URIPARAM":     `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\[\]<>-]*`,
+	"URIPATHPARAM": `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":          `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:Jan(?:uary)?|Feb(?:ruary)?|Mar(?:ch)?|Apr(?:il)?|May|June?|July?|Aug(?:ust)?|Sep(?:tember)?|Oct(?:ober)?|Nov(?:ember)?|Dec(?:ember)?)\b`,
+	"MONTHNUM":          `(?:0?[1-9]|1[0-2])`,
+	"MONTHDAY":          `(?:0[1-9]|[12][0-9]|3[01]|[1-9])`,
+	"YEAR":              `(?:\d\d){1,2}`,
+	"HOUR":              `(?:2[0123]|[01]?[0-9])`,
+	"MINUTE":            `(?:[0-5][0-9])`,
+	"SECOND":            `(?:(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?)`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})`,
+	"ISO8601_TIMEZONE":  `(?:Z|[+-]%{HOUR}(?::?%{MINUTE}))`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?%{ISO8601_TIMEZONE}?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+
+	"LOGLEVEL": `(?:[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo?(?:rmation)?|INFO?(?:RMATION)?|` +
+		`[Ww]arn?(?:ing)?|WARN?(?:ING)?|[Ee]rr?(?:or)?|ERR?(?:OR)?|[Cc]rit?(?:ical)?|CRIT?(?:ICAL)?|[Ff]atal|FATAL|` +
+		`[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?)`,
+}
+
+// grokReference matches %{NAME}, %{NAME:field} and %{NAME:field:type}.
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(\w+))?\}`)
+
+// maxGrokDepth bounds how deeply aliases are expanded.
+const maxGrokDepth = 16
+
+// grokPattern is a compiled grok pattern.
+type grokPattern struct {
+	re *regexp.Regexp
+	// fields are the names and types of the fields captured by each group
+	// of re, by group number; unnamed groups have an empty name.
+	fields []grokField
+}
+
+type grokField struct {
+	name string
+	kind string
+}
+
+// compileGrok compiles a grok pattern: a regular expression in which
+// %{NAME:field} captures what the alias NAME matches as field, and %{NAME}
+// matches it without capturing. A type of int or float, as in
+// %{NUMBER:bytes:int}, converts the captured text. Named groups such as
+// (?P<field>...) capture too.
+func compileGrok(pattern string) (*grokPattern, error) {
+	captures := make(map[string]grokField)
+	expanded, err := expandGrok(pattern, captures, 0)
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &grokPattern{re: re, fields: make([]grokField, len(re.SubexpNames()))}
+	for i, name := range re.SubexpNames() {
+		if field, ok := captures[name]; ok {
+			g.fields[i] = field
+		} else if name != "" {
+			g.fields[i] = grokField{name: name}
+		}
+	}
+	return g, nil
+}
+
+// expandGrok replaces the aliases in pattern with what they stand for,
+// naming the groups of captured ones after their entry in captures.
+func expandGrok(pattern string, captures map[string]grokField, depth int) (string, error) {
+	if depth > maxGrokDepth {
+		return "", errors.New("grok aliases nested too deeply")
+	}
+	// Go before 1.22 only accepts the (?P<name>...) syntax
+	pattern = strings.Replace(pattern, "(?<", "(?P<", -1)
+
+	var err error
+	expanded := grokReference.ReplaceAllStringFunc(pattern, func(ref string) string {
+		match := grokReference.FindStringSubmatch(ref)
+		alias, ok := grokAliases[match[1]]
+		if !ok {
+			err = errors.New("unknown grok pattern %{" + match[1] + "}")
+			return ""
+		}
+		expansion, e := expandGrok(alias, nil, depth+1)
+		if e != nil {
+			err = e
+			return ""
+		}
+		if match[2] == "" || captures == nil {
+			return "(?:" + expansion + ")"
+		}
+		switch match[3] {
+		case "", "int", "float":
+		default:
+			err = errors.New("unknown grok type " + match[3])
+			return ""
+		}
+		group := "_grok" + strconv.Itoa(len(captures))
+		captures[group] = grokField{name: match[2], kind: match[3]}
+		return "(?P<" + group + ">" + expansion + ")"
+	})
+	return expanded, err
+}
+
+// parse matches a line against the pattern, returning the line as the
+// message with the captured fields added. Groups that didn't take part in
+// the match are left out.
+func (g *grokPattern) parse(line string) (map[string]interface{}, bool) {
+	match := g.re.FindStringSubmatchIndex(line)
+	if match == nil {
+		return nil, false
+	}
+	data := map[string]interface{}{"message": line}
+	for i, field := range g.fields {
+		if field.name == "" || match[2*i] < 0 {
+			continue
+		}
+		text := line[match[2*i]:match[2*i+1]]
+		var value interface{} = text
+		switch field.kind {
+		case "int":
+			if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+				value = n
+			}
+		case "float":
+			if f, err := strconv.ParseFloat(text, 64); err == nil {
+				value = f
+			}
+		}
+		data[field.name] = value
+	}
+	return data, true
+}
+
+// containerGrokPattern returns the grok pattern of a container, configured
+// with the label logstash.grok or the environment variable LOGSTASH_GROK, or
+// nil if it has none or it doesn't compile.
+func containerGrokPattern(c *docker.Container, a *LogstashAdapter) *grokPattern {
+	grok, _ := a.metadata().get(c.ID, "grok", func() (interface{}, error) {
+		pattern := containerSetting(c, a, "logstash.grok", "LOGSTASH_GROK")
+		if pattern == "" {
+			return (*grokPattern)(nil), nil
+		}
+		g, err := compileGrok(pattern)
+		if err != nil {
+			a.log.with("container", c.ID).warnf("could not compile grok pattern: %s", err)
+			return (*grokPattern)(nil), nil
+		}
+		return g, nil
+	})
+	return grok.(*grokPattern)
+}
+
+// grokLine parses a line with the grok pattern of container c.
+func (a *LogstashAdapter) grokLine(c *docker.Container, line string) (map[string]interface{}, bool) {
+	if g := containerGrokPattern(c, a); g != nil {
+		return g.parse(line)
+	}
+	return nil, false
+}
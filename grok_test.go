@@ -0,0 +1,96 @@
+package logstash
+
+import (
+	"encoding/json"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrokPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	g, err := compileGrok(`^%{IP:client} \[%{HTTPDATE:time}\] "%{WORD:method} %{URIPATHPARAM:path}" %{NUMBER:status:int} %{NUMBER:duration:float}(?: %{NOTSPACE:extra})?(?<rest>.*)$`)
+	assert.Nil(err)
+
+	line := `10.1.2.3 [05/Apr/2023:06:07:08 +0000] "GET /a/b?c=d" 200 0.25 trailing`
+	data, ok := g.parse(line)
+	assert.True(ok)
+	assert.Equal(map[string]interface{}{
+		"message":  line,
+		"client":   "10.1.2.3",
+		"time":     "05/Apr/2023:06:07:08 +0000",
+		"method":   "GET",
+		"path":     "/a/b?c=d",
+		"status":   int64(200),
+		"duration": 0.25,
+		"extra":    "trailing",
+		"rest":     "",
+	}, data)
+
+	// optional groups that don't match are left out
+	data, ok = g.parse(`::1 [05/Apr/2023:06:07:08 +0000] "POST /" 404 1`)
+	assert.True(ok)
+	assert.Equal("::1", data["client"])
+	assert.NotContains(data, "extra")
+
+	_, ok = g.parse("not an access log")
+	assert.False(ok)
+
+	// captures can replace the message
+	g, err = compileGrok(`^%{LOGLEVEL:level} %{GREEDYDATA:message}`)
+	assert.Nil(err)
+	data, ok = g.parse("WARNING disk nearly full")
+	assert.True(ok)
+	assert.Equal(map[string]interface{}{"level": "WARNING", "message": "disk nearly full"}, data)
+
+	for _, pattern := range []string{`%{NOPE:x}`, `%{NUMBER:x:bool}`, `(unclosed`} {
+		_, err := compileGrok(pattern)
+		assert.NotNil(err, pattern)
+	}
+}
+
+func TestGrokParser(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	parser := func(id string, labels map[string]string) string {
+		return GetLineParser(&docker.Container{ID: id, Config: &docker.Config{Labels: labels}}, adapter)
+	}
+	assert.Equal(ParserGrok, parser("grok", map[string]string{"logstash.grok": "%{WORD:word}"}))
+	assert.Equal(ParserLogfmt, parser("logfmt", map[string]string{"logstash.grok": "%{WORD:word}", "logstash.parser": "logfmt"}))
+	assert.Equal(ParserJSON, parser("invalid", map[string]string{"logstash.grok": "%{NOPE}"}))
+	assert.Equal(ParserJSON, parser("missing", map[string]string{"logstash.parser": "grok"}))
+}
+
+func TestStreamGrok(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	container := &docker.Container{
+		ID:   "ID",
+		Name: "name",
+		Config: &docker.Config{Labels: map[string]string{
+			"logstash.grok": `^%{TIMESTAMP_ISO8601:time} %{LOGLEVEL:level} %{GREEDYDATA:message}$`,
+			"logstash.tags": "app",
+		}},
+	}
+	streamSourcedLines(adapter, container, stdoutLines("2023-04-05T06:07:08.123Z ERROR it broke", "free text")...)
+
+	writes := conn.Writes()
+	assert.Len(writes, 2)
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(writes[0]), &data))
+	assert.Equal("it broke", data["message"])
+	assert.Equal("ERROR", data["level"])
+	assert.Equal("2023-04-05T06:07:08.123Z", data["time"])
+	assert.Equal([]interface{}{"app"}, data["tags"])
+
+	data = nil
+	assert.Nil(json.Unmarshal([]byte(writes[1]), &data))
+	assert.Equal("free text", data["message"])
+	assert.Equal([]interface{}{"app", GrokFailureTag}, data["tags"])
+	assert.NotContains(data, "level")
+}
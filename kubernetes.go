@@ -0,0 +1,747 @@
+package logstash
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/yaml.v3"
+)
+
+// Defaults for enriching events from the Kubernetes API.
+const (
+	DefaultKubernetesLabels      = "*"
+	DefaultKubernetesAnnotations = ""
+	DefaultKubernetesNodeLabels  = ""
+	DefaultKubernetesSyncTimeout = 10 * time.Second
+	// how long a deleted pod is remembered, for lines read after it went away
+	DefaultKubernetesRetention = 5 * time.Minute
+)
+
+// Where pods find the credentials of their service account.
+var (
+	K8S_TOKEN_FILE = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	K8S_CA_FILE    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// Backoff between failed attempts to list or watch pods.
+var (
+	kubernetesBackoffMin = time.Second
+	kubernetesBackoffMax = time.Minute
+	// how long each watch request runs before it is renewed
+	kubernetesWatchTimeout = 5 * time.Minute
+	// how long a pod that couldn't be found isn't looked up again
+	kubernetesMissTimeout = 30 * time.Second
+)
+
+// Where the controllers owning other controllers are found, so events name
+// the Deployment of a ReplicaSet and the CronJob of a Job.
+var kubernetesOwnerPaths = map[string]string{
+	"ReplicaSet": "/apis/apps/v1/namespaces/%s/replicasets/%s",
+	"Job":        "/apis/batch/v1/namespaces/%s/jobs/%s",
+}
+
+// kubeClient makes requests to the Kubernetes API server.
+type kubeClient struct {
+	server    string
+	token     string
+	tokenFile string // read on every request, as service account tokens rotate
+	username  string
+	password  string
+	http      *http.Client
+}
+
+type kubeObjectMeta struct {
+	Name            string               `json:"name"`
+	Namespace       string               `json:"namespace"`
+	UID             string               `json:"uid"`
+	ResourceVersion string               `json:"resourceVersion"`
+	Labels          map[string]string    `json:"labels"`
+	Annotations     map[string]string    `json:"annotations"`
+	OwnerReferences []kubeOwnerReference `json:"ownerReferences"`
+}
+
+type kubeOwnerReference struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Controller bool   `json:"controller"`
+}
+
+type kubePod struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+}
+
+type kubeNode struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+}
+
+type kubePodList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubePod `json:"items"`
+}
+
+type kubeWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// kubeError is returned for requests the API server refused.
+type kubeError struct {
+	code    int
+	message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API returned %d: %s", e.code, e.message)
+}
+
+// podInfo is what events are enriched with for a pod.
+type podInfo struct {
+	fields  map[string]interface{} // the kubernetes field, not to be modified
+	deleted time.Time
+}
+
+// podCache keeps the pods of the local node up to date by listing and then
+// watching them, like the informers of client-go.
+type podCache struct {
+	client      *kubeClient
+	node        string
+	labels      []string
+	annotations []string
+	nodeLabels  []string
+	log         *logger
+
+	mu         sync.Mutex
+	nodeFields map[string]string    // the selected labels of the node, once fetched
+	pods       map[string]*podInfo  // by pod UID
+	owners     map[string][2]string // kind and name of the controller owning a controller
+	misses     map[string]time.Time // pods that couldn't be found, by UID
+
+	synced chan struct{}
+	cancel context.CancelFunc
+}
+
+// configureKubernetes starts watching the pods of the local node if the
+// kubernetes option is set, using a kubeconfig file if one is given and the
+// pod's service account otherwise.
+func (a *LogstashAdapter) configureKubernetes() error {
+	enabled := getopt(a.route, "kubernetes", "LOGSTASH_KUBERNETES", "")
+	if enabled == "" || enabled == "false" {
+		return nil
+	}
+
+	var client *kubeClient
+	var err error
+	if kubeconfig := getopt(a.route, "kubeconfig", "LOGSTASH_KUBECONFIG", os.Getenv("KUBECONFIG")); kubeconfig != "" {
+		client, err = newKubeClientFromConfig(kubeconfig)
+	} else {
+		client, err = newInClusterKubeClient()
+	}
+	if err != nil {
+		return err
+	}
+
+	node := getopt(a.route, "kubernetes_node", "LOGSTASH_KUBERNETES_NODE", os.Getenv("NODE_NAME"))
+	if node == "" {
+		if node, err = os.Hostname(); err != nil {
+			return err
+		}
+	}
+
+	a.kubernetes = newPodCache(client, node,
+		splitList(getopt(a.route, "kubernetes_labels", "LOGSTASH_KUBERNETES_LABELS", DefaultKubernetesLabels)),
+		splitList(getopt(a.route, "kubernetes_annotations", "LOGSTASH_KUBERNETES_ANNOTATIONS", DefaultKubernetesAnnotations)),
+		splitList(getopt(a.route, "kubernetes_node_labels", "LOGSTASH_KUBERNETES_NODE_LABELS", DefaultKubernetesNodeLabels)))
+	a.kubernetes.log = a.log.with("node", node)
+	a.kubernetes.start()
+	if !a.kubernetes.waitForSync(DefaultKubernetesSyncTimeout) {
+		a.log.warnf("timed out listing pods of node %s", node)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// newInClusterKubeClient returns a client using the service account of the
+// pod logspout runs in.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster and no kubeconfig given")
+	}
+	ca, err := ioutil.ReadFile(K8S_CA_FILE)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !config.RootCAs.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in " + K8S_CA_FILE)
+	}
+	return &kubeClient{
+		server:    "https://" + net.JoinHostPort(host, port),
+		tokenFile: K8S_TOKEN_FILE,
+		http:      newKubeHTTPClient(config),
+	}, nil
+}
+
+// kubeconfig holds the parts of a kubeconfig file needed to reach the API
+// server of its current context.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Username              string `yaml:"username"`
+			Password              string `yaml:"password"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubeClientFromConfig returns a client for the current context of a
+// kubeconfig file.
+func newKubeClientFromConfig(path string) (*kubeClient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, errors.New("invalid kubeconfig " + path + ": " + err.Error())
+	}
+
+	// paths in a kubeconfig are relative to the file
+	dir := filepath.Dir(path)
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(dir, file)
+	}
+	// load returns inline base64 data, or else the contents of file
+	load := func(inline, file string) ([]byte, error) {
+		if inline != "" {
+			return base64.StdEncoding.DecodeString(inline)
+		}
+		if file != "" {
+			return ioutil.ReadFile(resolve(file))
+		}
+		return nil, nil
+	}
+
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, errors.New("kubeconfig " + path + " has no context " + config.CurrentContext)
+	}
+
+	client := &kubeClient{}
+	tlsConfig := &tls.Config{}
+	found = false
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		client.server = strings.TrimSuffix(c.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := load(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, errors.New("no certificates in the certificate authority of cluster " + clusterName)
+			}
+		}
+	}
+	if !found || client.server == "" {
+		return nil, errors.New("kubeconfig " + path + " has no server for cluster " + clusterName)
+	}
+
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		client.token = u.User.Token
+		client.tokenFile = resolve(u.User.TokenFile)
+		client.username, client.password = u.User.Username, u.User.Password
+		cert, err := load(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, err
+		}
+		key, err := load(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil || key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+
+	client.http = newKubeHTTPClient(tlsConfig)
+	return client, nil
+}
+
+func newKubeHTTPClient(config *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}
+}
+
+// get sends a GET request for path and query to the API server. The caller
+// closes the body of the response.
+func (k *kubeClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := k.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	token := k.token
+	if k.tokenFile != "" {
+		data, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if k.username != "" {
+		req.SetBasicAuth(k.username, k.password)
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var status kubeStatus
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(body, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(body))
+		}
+		return nil, &kubeError{code: resp.StatusCode, message: status.Message}
+	}
+	return resp, nil
+}
+
+// getJSON decodes the object at path into v.
+func (k *kubeClient) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	resp, err := k.get(ctx, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func newPodCache(client *kubeClient, node string, labels, annotations, nodeLabels []string) *podCache {
+	return &podCache{
+		client:      client,
+		node:        node,
+		labels:      labels,
+		annotations: annotations,
+		nodeLabels:  nodeLabels,
+		pods:        make(map[string]*podInfo),
+		owners:      make(map[string][2]string),
+		misses:      make(map[string]time.Time),
+		synced:      make(chan struct{}),
+	}
+}
+
+// start lists and watches pods in the background until stop is called.
+func (p *podCache) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go p.run(ctx)
+}
+
+func (p *podCache) stop() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+}
+
+// waitForSync waits for the first list of pods to complete.
+func (p *podCache) waitForSync(timeout time.Duration) bool {
+	select {
+	case <-p.synced:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (p *podCache) run(ctx context.Context) {
+	var backoff time.Duration
+	for {
+		listed, err := p.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// pods are listed again straight away after a watch that ran
+		if listed {
+			backoff = 0
+		}
+		if backoff == 0 {
+			backoff = kubernetesBackoffMin
+		} else {
+			backoff *= 2
+		}
+		if backoff > kubernetesBackoffMax {
+			backoff = kubernetesBackoffMax
+		}
+		half := backoff / 2
+		wait := half + time.Duration(rand.Int63n(int64(half)+1))
+		p.log.warnf("could not watch pods, retrying in %s: %s", wait.Round(time.Millisecond), err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// listAndWatch lists the pods of the node and then follows changes to them
+// until the watch fails, reporting whether the list succeeded.
+func (p *podCache) listAndWatch(ctx context.Context) (bool, error) {
+	p.fetchNode(ctx)
+
+	selector := "spec.nodeName=" + p.node
+	var list kubePodList
+	if err := p.client.getJSON(ctx, "/api/v1/pods", url.Values{"fieldSelector": {selector}}, &list); err != nil {
+		return false, err
+	}
+
+	current := make(map[string]bool, len(list.Items))
+	for i := range list.Items {
+		current[list.Items[i].Metadata.UID] = true
+		p.store(ctx, &list.Items[i])
+	}
+	p.mu.Lock()
+	for uid, info := range p.pods {
+		if !current[uid] && info.deleted.IsZero() {
+			info.deleted = time.Now()
+		}
+	}
+	p.mu.Unlock()
+	p.markSynced()
+
+	version := list.Metadata.ResourceVersion
+	for {
+		query := url.Values{
+			"fieldSelector":       {selector},
+			"watch":               {"true"},
+			"resourceVersion":     {version},
+			"allowWatchBookmarks": {"true"},
+			"timeoutSeconds":      {fmt.Sprint(int(kubernetesWatchTimeout / time.Second))},
+		}
+		resp, err := p.client.get(ctx, "/api/v1/pods", query)
+		if err != nil {
+			return true, err
+		}
+		version, err = p.watch(ctx, resp.Body, version)
+		resp.Body.Close()
+		if err != nil {
+			return true, err
+		}
+		p.expire()
+	}
+}
+
+// watch applies the events of a watch response, returning the resource
+// version to continue from once the server ends it.
+func (p *podCache) watch(ctx context.Context, body io.Reader, version string) (string, error) {
+	decoder := json.NewDecoder(body)
+	for {
+		var ev kubeWatchEvent
+		if err := decoder.Decode(&ev); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return version, nil
+			}
+			return version, err
+		}
+
+		if ev.Type == "ERROR" {
+			var status kubeStatus
+			json.Unmarshal(ev.Object, &status)
+			// a 410 Gone means the version is too old, and pods are listed again
+			return version, &kubeError{code: status.Code, message: status.Message}
+		}
+
+		var pod kubePod
+		if err := json.Unmarshal(ev.Object, &pod); err != nil {
+			return version, err
+		}
+		version = pod.Metadata.ResourceVersion
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			p.store(ctx, &pod)
+		case "DELETED":
+			p.mu.Lock()
+			if info, ok := p.pods[pod.Metadata.UID]; ok {
+				info.deleted = time.Now()
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+func (p *podCache) markSynced() {
+	select {
+	case <-p.synced:
+	default:
+		close(p.synced)
+	}
+}
+
+// expire forgets pods that were deleted a while ago.
+func (p *podCache) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for uid, info := range p.pods {
+		if !info.deleted.IsZero() && time.Since(info.deleted) > DefaultKubernetesRetention {
+			delete(p.pods, uid)
+		}
+	}
+	for uid, missed := range p.misses {
+		if time.Since(missed) > kubernetesMissTimeout {
+			delete(p.misses, uid)
+		}
+	}
+}
+
+// fetchNode gets the labels of the node once, if any are to be added to
+// events. A node that couldn't be fetched is asked for again when pods are
+// next listed, and its pods have just the node name until then.
+func (p *podCache) fetchNode(ctx context.Context) {
+	p.mu.Lock()
+	fetched := p.nodeFields != nil
+	p.mu.Unlock()
+	if fetched || len(p.nodeLabels) == 0 {
+		return
+	}
+
+	var node kubeNode
+	if err := p.client.getJSON(ctx, "/api/v1/nodes/"+url.PathEscape(p.node), nil, &node); err != nil {
+		p.log.warnf("could not get node %s: %s", p.node, err)
+		return
+	}
+	p.mu.Lock()
+	p.nodeFields = dedot(selectKeys(node.Metadata.Labels, p.nodeLabels))
+	p.mu.Unlock()
+}
+
+// store records what events of a pod are enriched with.
+func (p *podCache) store(ctx context.Context, pod *kubePod) {
+	meta := pod.Metadata
+	fields := map[string]interface{}{
+		"namespace": meta.Namespace,
+		"pod":       map[string]interface{}{"name": meta.Name, "uid": meta.UID},
+	}
+	if pod.Spec.NodeName != "" {
+		node := map[string]interface{}{"name": pod.Spec.NodeName}
+		p.mu.Lock()
+		if pod.Spec.NodeName == p.node && len(p.nodeFields) > 0 {
+			node["labels"] = p.nodeFields
+		}
+		p.mu.Unlock()
+		fields["node"] = node
+	}
+	if labels := selectKeys(meta.Labels, p.labels); len(labels) > 0 {
+		fields["labels"] = dedot(labels)
+	}
+	if annotations := selectKeys(meta.Annotations, p.annotations); len(annotations) > 0 {
+		fields["annotations"] = dedot(annotations)
+	}
+	for _, owner := range meta.OwnerReferences {
+		if !owner.Controller {
+			continue
+		}
+		fields[strings.ToLower(owner.Kind)] = map[string]interface{}{"name": owner.Name}
+		if kind, name := p.owner(ctx, meta.Namespace, owner.Kind, owner.Name); kind != "" {
+			fields[strings.ToLower(kind)] = map[string]interface{}{"name": name}
+		}
+	}
+
+	p.mu.Lock()
+	p.pods[meta.UID] = &podInfo{fields: fields}
+	delete(p.misses, meta.UID)
+	p.mu.Unlock()
+}
+
+// owner returns the kind and name of the controller owning a ReplicaSet or
+// Job, if any.
+func (p *podCache) owner(ctx context.Context, namespace, kind, name string) (string, string) {
+	path, ok := kubernetesOwnerPaths[kind]
+	if !ok {
+		return "", ""
+	}
+	key := kind + "/" + namespace + "/" + name
+
+	p.mu.Lock()
+	owner, ok := p.owners[key]
+	p.mu.Unlock()
+	if ok {
+		return owner[0], owner[1]
+	}
+
+	var object struct {
+		Metadata kubeObjectMeta `json:"metadata"`
+	}
+	if err := p.client.getJSON(ctx, fmt.Sprintf(path, namespace, name), nil, &object); err != nil {
+		p.log.warnf("could not get %s %s/%s: %s", kind, namespace, name, err)
+		return "", ""
+	}
+	for _, ref := range object.Metadata.OwnerReferences {
+		if ref.Controller {
+			owner = [2]string{ref.Kind, ref.Name}
+		}
+	}
+
+	p.mu.Lock()
+	p.owners[key] = owner
+	p.mu.Unlock()
+	return owner[0], owner[1]
+}
+
+// lookup returns the kubernetes field for events of a container, fetching
+// its pod if the watch hasn't seen it yet.
+func (p *podCache) lookup(c *docker.Container) map[string]interface{} {
+	uid := c.Config.Labels[K8S_POD_UID_LABEL]
+	if uid == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	info, ok := p.pods[uid]
+	_, missed := p.misses[uid]
+	p.mu.Unlock()
+	if ok {
+		return info.fields
+	}
+
+	name, namespace := c.Config.Labels[K8S_POD_NAME_LABEL], c.Config.Labels[K8S_POD_NAMESPACE_LABEL]
+	if missed || name == "" || namespace == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultKubernetesSyncTimeout)
+	defer cancel()
+	var pod kubePod
+	err := p.client.getJSON(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/pods/"+url.PathEscape(name), nil, &pod)
+	if err == nil && pod.Metadata.UID == uid {
+		p.store(ctx, &pod)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.pods[uid].fields
+	}
+	if err != nil {
+		p.log.warnf("could not get pod %s/%s: %s", namespace, name, err)
+	}
+
+	p.mu.Lock()
+	p.misses[uid] = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// selectKeys returns the entries of m whose key is in patterns, where a
+// pattern ending in * matches keys starting with the rest of it.
+func selectKeys(m map[string]string, patterns []string) map[string]string {
+	result := make(map[string]string)
+	for k, v := range m {
+		for _, pattern := range patterns {
+			if k == pattern || strings.HasSuffix(pattern, "*") && strings.HasPrefix(k, strings.TrimSuffix(pattern, "*")) {
+				result[k] = v
+				break
+			}
+		}
+	}
+	return result
+}
+
+// GetKubernetesFields returns the kubernetes field of events of a container
+// from the Kubernetes API, or nil if it isn't watched or not in a pod.
+func GetKubernetesFields(c *docker.Container, a *LogstashAdapter) map[string]interface{} {
+	if a.kubernetes == nil {
+		return nil
+	}
+	return a.kubernetes.lookup(c)
+}
@@ -0,0 +1,294 @@
+package logstash
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKubeAPI serves pods and their owners like the Kubernetes API server,
+// streaming the events sent on watch to watch requests.
+type fakeKubeAPI struct {
+	token   string
+	pods    []kubePod
+	objects map[string]interface{}
+	watch   chan kubeWatchEvent
+}
+
+func newFakeKubeAPI(pods ...kubePod) *fakeKubeAPI {
+	return &fakeKubeAPI{
+		token:   "secret",
+		pods:    pods,
+		objects: make(map[string]interface{}),
+		watch:   make(chan kubeWatchEvent, 10),
+	}
+}
+
+func (f *fakeKubeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(kubeStatus{Code: 401, Message: "Unauthorized"})
+		return
+	}
+
+	if r.URL.Path == "/api/v1/pods" {
+		if r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			list := kubePodList{Items: f.pods}
+			list.Metadata.ResourceVersion = "1"
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case ev := <-f.watch:
+				json.NewEncoder(w).Encode(ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+
+	object, ok := f.objects[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(kubeStatus{Code: 404, Message: "not found"})
+		return
+	}
+	json.NewEncoder(w).Encode(object)
+}
+
+func (f *fakeKubeAPI) send(t *testing.T, kind string, pod kubePod) {
+	object, err := json.Marshal(pod)
+	assert.Nil(t, err)
+	f.watch <- kubeWatchEvent{Type: kind, Object: object}
+}
+
+func newKubePod(uid, name string, owners ...kubeOwnerReference) kubePod {
+	pod := kubePod{Metadata: kubeObjectMeta{
+		Name:            name,
+		Namespace:       "default",
+		UID:             uid,
+		ResourceVersion: "2",
+		Labels:          map[string]string{"app": name, "app.kubernetes.io/part-of": "shop", "pod-template-hash": "5d8f"},
+		Annotations:     map[string]string{"example.com/team": "payments", "kubectl.kubernetes.io/last-applied-configuration": "{}"},
+		OwnerReferences: owners,
+	}}
+	pod.Spec.NodeName = "node-1"
+	return pod
+}
+
+func podContainer(uid, name string) *docker.Container {
+	return &docker.Container{
+		ID: "ID",
+		Config: &docker.Config{Labels: map[string]string{
+			K8S_POD_UID_LABEL:       uid,
+			K8S_POD_NAME_LABEL:      name,
+			K8S_POD_NAMESPACE_LABEL: "default",
+		}},
+	}
+}
+
+func newTestPodCache(api *fakeKubeAPI) (*podCache, func()) {
+	server := httptest.NewServer(api)
+	client := &kubeClient{server: server.URL, token: api.token, http: server.Client()}
+	cache := newPodCache(client, "node-1", []string{"app*"}, []string{"example.com/*"}, []string{"topology.kubernetes.io/*"})
+	cache.start()
+	return cache, func() {
+		cache.stop()
+		server.Close()
+	}
+}
+
+// eventually polls lookup until it returns a result or a second passes.
+func eventually(lookup func() map[string]interface{}) map[string]interface{} {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if fields := lookup(); fields != nil {
+			return fields
+		}
+	}
+	return nil
+}
+
+func TestKubernetesWatchPods(t *testing.T) {
+	assert := assert.New(t)
+
+	api := newFakeKubeAPI(newKubePod("uid-1", "web-5d8f-abcde", kubeOwnerReference{Kind: "ReplicaSet", Name: "web-5d8f", Controller: true}))
+	api.objects["/apis/apps/v1/namespaces/default/replicasets/web-5d8f"] = map[string]interface{}{
+		"metadata": kubeObjectMeta{OwnerReferences: []kubeOwnerReference{{Kind: "Deployment", Name: "web", Controller: true}}},
+	}
+	cache, stop := newTestPodCache(api)
+	defer stop()
+	assert.True(cache.waitForSync(time.Second))
+
+	assert.Equal(map[string]interface{}{
+		"namespace":   "default",
+		"pod":         map[string]interface{}{"name": "web-5d8f-abcde", "uid": "uid-1"},
+		"node":        map[string]interface{}{"name": "node-1"},
+		"replicaset":  map[string]interface{}{"name": "web-5d8f"},
+		"deployment":  map[string]interface{}{"name": "web"},
+		"labels":      map[string]string{"app": "web-5d8f-abcde", "app_kubernetes_io/part-of": "shop"},
+		"annotations": map[string]string{"example_com/team": "payments"},
+	}, cache.lookup(podContainer("uid-1", "web-5d8f-abcde")))
+
+	// pods started later are picked up from the watch
+	api.send(t, "ADDED", newKubePod("uid-2", "db-0", kubeOwnerReference{Kind: "StatefulSet", Name: "db", Controller: true}))
+	fields := eventually(func() map[string]interface{} {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		if info, ok := cache.pods["uid-2"]; ok {
+			return info.fields
+		}
+		return nil
+	})
+	assert.Equal(map[string]interface{}{"name": "db"}, fields["statefulset"])
+
+	// deleted pods are kept for lines read after they went away
+	api.send(t, "DELETED", newKubePod("uid-2", "db-0"))
+	deleted := eventually(func() map[string]interface{} {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		if !cache.pods["uid-2"].deleted.IsZero() {
+			return cache.pods["uid-2"].fields
+		}
+		return nil
+	})
+	assert.NotNil(deleted)
+	assert.NotNil(cache.lookup(podContainer("uid-2", "db-0")))
+}
+
+func TestKubernetesNodeLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	api := newFakeKubeAPI(newKubePod("uid-1", "web-5d8f-abcde"))
+	api.objects["/api/v1/nodes/node-1"] = kubeNode{Metadata: kubeObjectMeta{Name: "node-1", Labels: map[string]string{
+		"topology.kubernetes.io/zone":   "eu-west-1a",
+		"topology.kubernetes.io/region": "eu-west-1",
+		"kubernetes.io/os":              "linux",
+	}}}
+	cache, stop := newTestPodCache(api)
+	defer stop()
+	assert.True(cache.waitForSync(time.Second))
+
+	assert.Equal(map[string]interface{}{
+		"name":   "node-1",
+		"labels": map[string]string{"topology_kubernetes_io/zone": "eu-west-1a", "topology_kubernetes_io/region": "eu-west-1"},
+	}, cache.lookup(podContainer("uid-1", "web-5d8f-abcde"))["node"])
+}
+
+func TestKubernetesLookupMissingPod(t *testing.T) {
+	assert := assert.New(t)
+
+	api := newFakeKubeAPI()
+	cache, stop := newTestPodCache(api)
+	defer stop()
+	assert.True(cache.waitForSync(time.Second))
+
+	// a pod the watch hasn't delivered yet is fetched directly
+	api.objects["/api/v1/namespaces/default/pods/job-xyz"] = newKubePod("uid-3", "job-xyz")
+	fields := cache.lookup(podContainer("uid-3", "job-xyz"))
+	assert.Equal(map[string]interface{}{"name": "job-xyz", "uid": "uid-3"}, fields["pod"])
+
+	// and one that can't be found isn't asked for again for a while
+	assert.Nil(cache.lookup(podContainer("uid-4", "gone")))
+	api.objects["/api/v1/namespaces/default/pods/gone"] = newKubePod("uid-4", "gone")
+	assert.Nil(cache.lookup(podContainer("uid-4", "gone")))
+
+	// containers outside of pods have no kubernetes fields
+	assert.Nil(cache.lookup(&docker.Container{Config: &docker.Config{}}))
+}
+
+func TestStreamKubernetesFields(t *testing.T) {
+	assert := assert.New(t)
+
+	api := newFakeKubeAPI(newKubePod("uid-1", "web-5d8f-abcde"))
+	cache, stop := newTestPodCache(api)
+	defer stop()
+	assert.True(cache.waitForSync(time.Second))
+
+	for _, schema := range []string{SchemaLegacy, SchemaECS} {
+		conn := &recordingConn{}
+		adapter := newBatchingAdapter("logstash+tcp", conn)
+		adapter.schema = schema
+		adapter.kubernetes = cache
+
+		container := multilineContainer(podContainer("uid-1", "web-5d8f-abcde").Config.Labels)
+		streamSourcedLines(adapter, container, stdoutLines("hello")...)
+
+		writes := conn.Writes()
+		assert.Len(writes, 1)
+		var data map[string]interface{}
+		assert.Nil(json.Unmarshal([]byte(writes[0]), &data))
+		kubernetes, _ := data["kubernetes"].(map[string]interface{})
+		assert.Equal("default", kubernetes["namespace"], schema)
+		assert.Equal(map[string]interface{}{"name": "node-1"}, kubernetes["node"], schema)
+		assert.Equal(map[string]interface{}{"app": "web-5d8f-abcde", "app_kubernetes_io/part-of": "shop"}, kubernetes["labels"], schema)
+	}
+}
+
+func TestKubeClientFromConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	api := newFakeKubeAPI(newKubePod("uid-1", "web"))
+	server := httptest.NewTLSServer(api)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "logstash-kubeconfig")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "token"), []byte(api.token+"\n"), 0600))
+	config := `apiVersion: v1
+kind: Config
+current-context: test
+contexts:
+- name: other
+  context: {cluster: other, user: other}
+- name: test
+  context: {cluster: test, user: test}
+clusters:
+- name: test
+  cluster:
+    server: ` + server.URL + `/
+    certificate-authority-data: ` + base64.StdEncoding.EncodeToString(ca) + `
+users:
+- name: test
+  user:
+    tokenFile: token
+`
+	path := filepath.Join(dir, "config")
+	assert.Nil(ioutil.WriteFile(path, []byte(config), 0600))
+
+	client, err := newKubeClientFromConfig(path)
+	assert.Nil(err)
+	var list kubePodList
+	assert.Nil(client.getJSON(context.Background(), "/api/v1/pods", map[string][]string{"fieldSelector": {"spec.nodeName=node-1"}}, &list))
+	assert.Len(list.Items, 1)
+
+	// the API server's errors are passed on
+	client.tokenFile = ""
+	client.token = "wrong"
+	err = client.getJSON(context.Background(), "/api/v1/pods", nil, &list)
+	assert.Equal(&kubeError{code: 401, message: "Unauthorized"}, err)
+
+	assert.Nil(ioutil.WriteFile(path, []byte("current-context: missing\n"), 0600))
+	_, err = newKubeClientFromConfig(path)
+	assert.NotNil(err)
+}
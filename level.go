@@ -0,0 +1,214 @@
+package logstash
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// defaultLevels maps the level names and numbers applications log with to
+// the normalised levels of events. The entries stdout and stderr are the
+// levels of lines that don't have one.
+var defaultLevels = map[string]string{
+	"trace":         "trace",
+	"verbose":       "trace",
+	"debug":         "debug",
+	"dbg":           "debug",
+	"info":          "info",
+	"inf":           "info",
+	"information":   "info",
+	"informational": "info",
+	"notice":        "notice",
+	"warn":          "warn",
+	"warning":       "warn",
+	"wrn":           "warn",
+	"error":         "error",
+	"err":           "error",
+	"severe":        "error",
+	"crit":          "critical",
+	"critical":      "critical",
+	"fatal":         "critical",
+	"alert":         "alert",
+	"emerg":         "emergency",
+	"emergency":     "emergency",
+	"panic":         "emergency",
+
+	// syslog severities
+	"0": "emergency",
+	"1": "alert",
+	"2": "critical",
+	"3": "error",
+	"4": "warn",
+	"5": "notice",
+	"6": "info",
+	"7": "debug",
+
+	// bunyan and pino levels
+	"10": "trace",
+	"20": "debug",
+	"30": "info",
+	"40": "warn",
+	"50": "error",
+	"60": "critical",
+
+	"stdout": "info",
+	"stderr": "error",
+}
+
+// levelKeys are the fields of decoded lines that hold their level, in the
+// order they are looked at. Dotted keys also match nested objects.
+var levelKeys = []string{"level", "severity", "lvl", "log.level"}
+
+// logfmtLevel finds the level of lines with logfmt pairs that weren't parsed
+// as logfmt.
+var logfmtLevel = regexp.MustCompile(`(?:^|\s)(?:level|lvl|severity)="?([A-Za-z]+)"?(?:\s|$)`)
+
+// maxLevelPrefix is how many leading words, such as the date and time, are
+// skipped when looking for the level a line starts with.
+const maxLevelPrefix = 4
+
+// configureLevels reads whether events get a normalised level, and the
+// table of level names to use. Entries of level_map, such as
+// "verbose=debug,stderr=warn", add to or replace the default ones, and an
+// empty level removes a name.
+func (a *LogstashAdapter) configureLevels() error {
+	detect, err := strconv.ParseBool(getopt(a.route, "level_detection", "LOGSTASH_LEVEL_DETECTION", "false"))
+	if err != nil {
+		return errors.New("invalid level_detection: " + err.Error())
+	}
+	if !detect {
+		return nil
+	}
+
+	a.levels = make(map[string]string, len(defaultLevels))
+	for name, level := range defaultLevels {
+		a.levels[name] = level
+	}
+	for _, entry := range splitList(getopt(a.route, "level_map", "LOGSTASH_LEVEL_MAP", "")) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return errors.New("invalid level_map entry: " + entry)
+		}
+		a.levels[strings.ToLower(strings.TrimSpace(entry[:i]))] = strings.TrimSpace(entry[i+1:])
+	}
+	return nil
+}
+
+// setLevel adds the normalised level of an event, if level detection is on,
+// as its level field, or as log.level in the ECS schema. A level the line
+// already has there that isn't a known name is left alone, so no value of
+// the source is lost.
+func (a *LogstashAdapter) setLevel(data map[string]interface{}, stream string) {
+	if a.levels == nil {
+		return
+	}
+	level := a.eventLevel(data, stream)
+	if level == "" {
+		return
+	}
+	target := data
+	if a.schema == SchemaECS {
+		log, ok := data["log"].(map[string]interface{})
+		if !ok {
+			log = make(map[string]interface{})
+			data["log"] = log
+		}
+		target = log
+	}
+	if current, ok := target["level"]; ok && a.knownLevel(current) == "" {
+		return
+	}
+	target["level"] = level
+}
+
+// eventLevel returns the normalised level of an event. It is taken from the
+// first of the levelKeys the event has with a known level, a logfmt level
+// pair in the message, or a level the message starts with, such as ERROR:
+// or [info], and otherwise from the stream the line was written to.
+func (a *LogstashAdapter) eventLevel(data map[string]interface{}, stream string) string {
+	for _, key := range levelKeys {
+		if level := a.knownLevel(fieldValue(data, key)); level != "" {
+			return level
+		}
+	}
+
+	if message, ok := data["message"].(string); ok {
+		if match := logfmtLevel.FindStringSubmatch(message); match != nil {
+			if level := a.levels[strings.ToLower(match[1])]; level != "" {
+				return level
+			}
+		}
+		if level := a.leadingLevel(message); level != "" {
+			return level
+		}
+	}
+
+	return a.levels[stream]
+}
+
+// knownLevel returns the normalised level of a level name or number, or an
+// empty string if it isn't one.
+func (a *LogstashAdapter) knownLevel(value interface{}) string {
+	var name string
+	switch value := value.(type) {
+	case string:
+		name = value
+	case float64:
+		name = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return ""
+	}
+	return a.levels[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// leadingLevel returns the level a message starts with, after any words
+// starting with digits, such as a date and time, and punctuation. So that
+// ordinary sentences aren't taken for one, the level must be in brackets,
+// followed by a colon or in capitals, as in [info], Warning: or ERROR.
+func (a *LogstashAdapter) leadingLevel(message string) string {
+	words := strings.Fields(message)
+	if len(words) > maxLevelPrefix+1 {
+		words = words[:maxLevelPrefix+1]
+	}
+	for _, word := range words {
+		name := strings.Trim(word, "[]()<>{}:|-")
+		switch {
+		case name == "":
+			continue
+		case name[0] >= '0' && name[0] <= '9':
+			continue
+		case !isLetters(name):
+			return ""
+		}
+		bracketed := strings.IndexByte("[(<{", word[0]) >= 0 && strings.IndexByte("])>}:", word[len(word)-1]) >= 0
+		if !bracketed && !strings.HasSuffix(word, ":") && name != strings.ToUpper(name) {
+			return ""
+		}
+		return a.levels[strings.ToLower(name)]
+	}
+	return ""
+}
+
+func isLetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// fieldValue returns the value of a field of an event, following the dots
+// of a key into nested objects when there is no field with the dotted name.
+func fieldValue(data map[string]interface{}, key string) interface{} {
+	if value, ok := data[key]; ok {
+		return value
+	}
+	if i := strings.Index(key, "."); i > 0 {
+		if object, ok := data[key[:i]].(map[string]interface{}); ok {
+			return fieldValue(object, key[i+1:])
+		}
+	}
+	return nil
+}
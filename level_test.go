@@ -0,0 +1,127 @@
+package logstash
+
+import (
+	"encoding/json"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLevelAdapter(t *testing.T, opts map[string]string) *LogstashAdapter {
+	adapter := &LogstashAdapter{route: newRoute(opts)}
+	assert.Nil(t, adapter.configureLevels())
+	return adapter
+}
+
+func TestEventLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := newLevelAdapter(t, map[string]string{"level_detection": "true"})
+	for _, c := range []struct {
+		data   map[string]interface{}
+		stream string
+		level  string
+	}{
+		{map[string]interface{}{"level": "WARNING"}, "stdout", "warn"},
+		{map[string]interface{}{"severity": "Fatal", "message": "ERROR: x"}, "stdout", "critical"},
+		{map[string]interface{}{"log.level": "notice"}, "stdout", "notice"},
+		{map[string]interface{}{"log": map[string]interface{}{"level": "err"}}, "stdout", "error"},
+		{map[string]interface{}{"level": float64(30)}, "stderr", "info"},
+		{map[string]interface{}{"level": float64(4)}, "stdout", "warn"},
+		{map[string]interface{}{"message": `time=now level=debug msg="x"`}, "stdout", "debug"},
+		{map[string]interface{}{"message": "ERROR: could not connect"}, "stdout", "error"},
+		{map[string]interface{}{"message": "[info] listening"}, "stderr", "info"},
+		{map[string]interface{}{"message": "2023-04-05 06:07:08,123 - WARN [main] slow"}, "stdout", "warn"},
+		{map[string]interface{}{"message": "[2023-04-05T06:07:08Z] <Trace> x"}, "stderr", "trace"},
+		{map[string]interface{}{"message": "listening on :80"}, "stdout", "info"},
+		{map[string]interface{}{"message": "3 errors found"}, "stdout", "info"},
+		{map[string]interface{}{"message": "Apr 05 error"}, "stderr", "error"},
+		{map[string]interface{}{"message": "Warning: disk almost full"}, "stdout", "warn"},
+		{map[string]interface{}{"message": "[2023-04-05 06:07:08] DEBUG cache miss"}, "stdout", "debug"},
+		{map[string]interface{}{"message": "Error budget report generated"}, "stdout", "info"},
+		{map[string]interface{}{"message": "info about the cache"}, "stderr", "error"},
+	} {
+		assert.Equal(c.level, adapter.eventLevel(c.data, c.stream), "%v", c.data)
+	}
+}
+
+func TestConfigureLevels(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := newLevelAdapter(t, map[string]string{})
+	assert.Nil(adapter.levels)
+	data := map[string]interface{}{"level": "WARNING"}
+	adapter.setLevel(data, "stdout")
+	assert.Equal("WARNING", data["level"])
+
+	adapter = newLevelAdapter(t, map[string]string{
+		"level_detection": "true",
+		"level_map":       "Verbose=debug, fatal=fatal,stderr=,warning=warning",
+	})
+	assert.Equal("debug", adapter.eventLevel(map[string]interface{}{"level": "verbose"}, "stdout"))
+	assert.Equal("fatal", adapter.eventLevel(map[string]interface{}{"level": "FATAL"}, "stdout"))
+	assert.Equal("warning", adapter.eventLevel(map[string]interface{}{"message": "WARNING: x"}, "stdout"))
+	assert.Equal("", adapter.eventLevel(map[string]interface{}{"message": "x"}, "stderr"))
+
+	data = map[string]interface{}{"message": "x"}
+	adapter.setLevel(data, "stderr")
+	assert.NotContains(data, "level")
+
+	// levels the source logged that aren't known are kept
+	adapter = newLevelAdapter(t, map[string]string{"level_detection": "true"})
+	data = map[string]interface{}{"lvl": "dbug", "level": "nonsense"}
+	adapter.setLevel(data, "stderr")
+	assert.Equal("nonsense", data["level"])
+	data = map[string]interface{}{"level": "verbose2", "message": "ERROR: x"}
+	adapter.setLevel(data, "stdout")
+	assert.Equal("verbose2", data["level"])
+	data = map[string]interface{}{"level": float64(50)}
+	adapter.setLevel(data, "stdout")
+	assert.Equal("error", data["level"])
+
+	for _, opts := range []map[string]string{
+		{"level_detection": "maybe"},
+		{"level_detection": "true", "level_map": "warn"},
+		{"level_detection": "true", "level_map": "=warn"},
+	} {
+		adapter := &LogstashAdapter{route: newRoute(opts)}
+		assert.NotNil(adapter.configureLevels(), "%v", opts)
+	}
+}
+
+func TestSetLevelECS(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := newLevelAdapter(t, map[string]string{"level_detection": "true"})
+	adapter.schema = SchemaECS
+	data := map[string]interface{}{"log": map[string]interface{}{"logger": "main"}, "level": "Warning"}
+	adapter.setLevel(data, "stdout")
+	assert.Equal(map[string]interface{}{"logger": "main", "level": "warn"}, data["log"])
+	assert.Equal("Warning", data["level"])
+	data = map[string]interface{}{"log": map[string]interface{}{"level": "custom"}}
+	adapter.setLevel(data, "stderr")
+	assert.Equal(map[string]interface{}{"level": "custom"}, data["log"])
+	assert.Equal(SeverityInformational, eventSeverity(map[string]interface{}{"log": map[string]interface{}{"level": "info"}}, "stderr"))
+	assert.Equal(SeverityWarning, eventSeverity(map[string]interface{}{"log": map[string]interface{}{"level": "warn"}}, "stdout"))
+}
+
+func TestStreamLevels(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	adapter.levels = defaultLevels
+	streamSourcedLines(adapter, &docker.Container{ID: "ID", Name: "name", Config: &docker.Config{}},
+		sourcedLine{"stdout", `{"level": "WARNING", "message": "slow"}`},
+		sourcedLine{"stderr", "something failed"},
+		sourcedLine{"stdout", "INFO starting"})
+
+	var levels []interface{}
+	for _, write := range conn.Writes() {
+		var data map[string]interface{}
+		assert.Nil(json.Unmarshal([]byte(write), &data))
+		levels = append(levels, data["level"])
+	}
+	assert.Equal([]interface{}{"warn", "error", "info"}, levels)
+}
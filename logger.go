@@ -0,0 +1,147 @@
+package logstash
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Levels of the adapter's own log messages.
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Formats of the adapter's own log messages.
+const (
+	// LogFormatText writes messages through the standard logger, as
+	// "WARN logstash: message key=value".
+	LogFormatText = "text"
+	// LogFormatJSON writes each message as a line of JSON, so it can be
+	// shipped like any other container's logs.
+	LogFormatJSON = "json"
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// defaultLogger is used where no route is known, and by adapters not created
+// by NewLogstashAdapter.
+var defaultLogger, _ = newLogger(&router.Route{})
+
+// logger writes the adapter's own messages at or above its level, with the
+// fields it was given, such as the route and container they concern. A nil
+// logger is the default logger.
+type logger struct {
+	level  int
+	json   bool
+	route  *router.Route // named in messages once logspout has given it an ID
+	fields []string      // keys and values
+}
+
+// newLogger returns a logger configured by the log_level and log_format
+// route options, or LOGSTASH_LOG_LEVEL and LOGSTASH_LOG_FORMAT. The level
+// defaults to debug if DEBUG is set, and info otherwise.
+func newLogger(route *router.Route) (*logger, error) {
+	level := "info"
+	if os.Getenv("DEBUG") != "" {
+		level = "debug"
+	}
+	level = strings.ToLower(getopt(route, "log_level", "LOGSTASH_LOG_LEVEL", level))
+
+	l := &logger{level: -1}
+	for i, name := range levelNames {
+		if level == name || (level == "warning" && name == "warn") {
+			l.level = i
+		}
+	}
+	if l.level < 0 {
+		return &logger{level: LevelInfo}, errors.New("unknown log_level: " + level)
+	}
+
+	switch format := getopt(route, "log_format", "LOGSTASH_LOG_FORMAT", LogFormatText); format {
+	case LogFormatText:
+	case LogFormatJSON:
+		l.json = true
+	default:
+		return l, errors.New("unknown log_format: " + format)
+	}
+	l.route = route
+	return l, nil
+}
+
+// configureLogging sets up the logger of the adapter.
+func (a *LogstashAdapter) configureLogging() error {
+	var err error
+	a.log, err = newLogger(a.route)
+	return err
+}
+
+// with returns a logger that adds the given keys and values to messages.
+func (l *logger) with(kv ...string) *logger {
+	if l == nil {
+		l = defaultLogger
+	}
+	fields := make([]string, 0, len(l.fields)+len(kv))
+	return &logger{level: l.level, json: l.json, route: l.route, fields: append(append(fields, l.fields...), kv...)}
+}
+
+// allFields returns the keys and values added to messages, starting with the
+// route's ID. Routes only get their ID after the adapter has been created, so
+// it is read when messages are written.
+func (l *logger) allFields() []string {
+	if l.route == nil || l.route.ID == "" {
+		return l.fields
+	}
+	return append([]string{"route", l.route.ID}, l.fields...)
+}
+
+func (l *logger) debugf(format string, v ...interface{}) { l.logf(LevelDebug, format, v...) }
+func (l *logger) infof(format string, v ...interface{})  { l.logf(LevelInfo, format, v...) }
+func (l *logger) warnf(format string, v ...interface{})  { l.logf(LevelWarn, format, v...) }
+func (l *logger) errorf(format string, v ...interface{}) { l.logf(LevelError, format, v...) }
+
+func (l *logger) logf(level int, format string, v ...interface{}) {
+	if l == nil {
+		l = defaultLogger
+	}
+	if level < l.level {
+		return
+	}
+	message := fmt.Sprintf(format, v...)
+	fields := l.allFields()
+
+	if l.json {
+		entry := map[string]string{
+			"time":    time.Now().UTC().Format(time.RFC3339Nano),
+			"level":   levelNames[level],
+			"logger":  "logstash",
+			"message": message,
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry[fields[i]] = fields[i+1]
+		}
+		js, _ := json.Marshal(entry)
+		log.Writer().Write(append(js, '\n'))
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(levelNames[level]) + " logstash: " + message)
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fields[i+1]
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + fields[i] + "=" + value)
+	}
+	log.Print(b.String())
+}
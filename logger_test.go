@@ -0,0 +1,82 @@
+package logstash
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+// captureLog returns what the standard logger writes while f runs, without
+// timestamps.
+func captureLog(f func()) string {
+	var buf bytes.Buffer
+	flags, out := log.Flags(), log.Writer()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	}()
+	f()
+	return buf.String()
+}
+
+func TestLoggerText(t *testing.T) {
+	assert := assert.New(t)
+
+	// logspout gives routes their ID after creating their adapter
+	route := &router.Route{Options: map[string]string{"log_level": "WARNING"}}
+	l, err := newLogger(route)
+	assert.Nil(err)
+	route.ID = "abc123"
+
+	out := captureLog(func() {
+		l.infof("not shown")
+		l.with("container", "c1").warnf("could not do %s", "things")
+		l.with("destination", "host:5000", "note", "two words").errorf("broken")
+	})
+	assert.Equal("WARN logstash: could not do things route=abc123 container=c1\n"+
+		`ERROR logstash: broken route=abc123 destination=host:5000 note="two words"`+"\n", out)
+}
+
+func TestLoggerJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	l, err := newLogger(&router.Route{ID: "abc123", Options: map[string]string{"log_level": "debug", "log_format": "json"}})
+	assert.Nil(err)
+
+	out := captureLog(func() {
+		l.with("container", "c1").debugf("format %s is %d%%", "ok", 100)
+	})
+	var entry map[string]string
+	assert.Nil(json.Unmarshal([]byte(out), &entry))
+	assert.True(strings.HasSuffix(out, "}\n"))
+	assert.Equal("debug", entry["level"])
+	assert.Equal("format ok is 100%", entry["message"])
+	assert.Equal("abc123", entry["route"])
+	assert.Equal("c1", entry["container"])
+	assert.NotEmpty(entry["time"])
+}
+
+func TestLoggerDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	// adapters not created by NewLogstashAdapter log at the default level
+	var l *logger
+	out := captureLog(func() {
+		l.debugf("not shown")
+		l.infof("shown")
+		l.with("container", "c1").infof("also shown")
+	})
+	assert.Equal("INFO logstash: shown\nINFO logstash: also shown container=c1\n", out)
+
+	_, err := newLogger(newRoute(map[string]string{"log_level": "loud"}))
+	assert.NotNil(err)
+	_, err = newLogger(newRoute(map[string]string{"log_format": "xml"}))
+	assert.NotNil(err)
+}
@@ -1,11 +1,10 @@
 package logstash
 
 import (
-	"encoding/json"
 	"errors"
-	"log"
-	"net"
+	"math"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -17,34 +16,83 @@ func init() {
 	router.AdapterFactories.Register(NewLogstashAdapter, "logstash")
 }
 
-func debug(v ...interface{}) {
-	if os.Getenv("DEBUG") != "" {
-		log.Println(v...)
+// getopt returns the route option opt if it is set, falling back to the
+// environment variable env and then to dfault.
+func getopt(route *router.Route, opt, env, dfault string) string {
+	if value := route.Options[opt]; value != "" {
+		return value
 	}
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return dfault
 }
 
+const (
+	// TimestampDocker stamps events with the time Docker read the log line.
+	TimestampDocker = "docker"
+	// TimestampJson keeps a timestamp found in a decoded JSON log line,
+	// using the Docker time only when there isn't one.
+	TimestampJson = "json"
+)
+
+// Keys checked, in order, for a timestamp in decoded JSON log lines.
+var JSON_TIMESTAMP_KEYS = []string{"@timestamp", "timestamp", "time"}
+
 var K8S_POD_UID_LABEL = "io.kubernetes.pod.uid"
 var K8S_POD_TYPE_LABEL = "io.kubernetes.docker.type"
 var K8S_POD_PARENT_TYPE = "podsandbox"
 var K8S_POD_CONTAINER_TYPE = "container"
 var K8S_IO_PREFIX = "io.kubernetes."
 var K8S_ANNOTATION_PREFIX = "annotation.kubernetes.io/"
+var K8S_SETTING_ANNOTATION_PREFIX = "annotation.logstash."
 
 type DockerClient interface {
 	CreateContainer(docker.CreateContainerOptions) (*docker.Container, error)
 	ListContainers(docker.ListContainersOptions) ([]docker.APIContainers, error)
 	Info() (*docker.DockerInfo, error)
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	RemoveEventListener(listener chan *docker.APIEvents) error
 }
 
-// LogstashAdapter is an adapter that streams UDP JSON to Logstash.
+// LogstashAdapter is an adapter that streams UDP JSON to one or more Logstash
+// endpoints.
 type LogstashAdapter struct {
-	conn           net.Conn
-	route          *router.Route
-	containerTags  map[string][]string
-	logstashFields map[string]map[string]string
-	decodeJsonLogs map[string]bool
-	k8sLabels      map[string]map[string]string
-	client         DockerClient
+	route           *router.Route
+	cache           *metadataCache
+	client          DockerClient
+	timestampMode   string
+	queueSize       int
+	batchSize       int
+	batchBytes      int
+	flushInterval   time.Duration
+	writeTimeout    time.Duration
+	queue           chan event
+	done            chan struct{}
+	backlog         backlog
+	transport       router.AdapterTransport
+	endpoints       []*endpoint
+	balance         string
+	next            int
+	backoffMin      time.Duration
+	backoffMax      time.Duration
+	partials        *partialJoiner
+	multiline       *multilineJoiner
+	schema          string
+	kubernetes      *podCache
+	cacheTTL        time.Duration
+	cacheSize       int
+	format          string
+	gelfCompression string
+	gelfChunkSize   int
+	syslogFacility  int
+	enterpriseID    string
+	filtered        filterCounters
+	metrics         *adapterMetrics
+	log             *logger
+	udpMaxSize      int
+	udpOversize     string
+	levels          map[string]string
 }
 
 // NewLogstashAdapter creates a LogstashAdapter with UDP as the default transport.
@@ -54,85 +102,210 @@ func NewLogstashAdapter(route *router.Route) (router.LogAdapter, error) {
 		return nil, errors.New("unable to find adapter: " + route.Adapter)
 	}
 
+	adapter := &LogstashAdapter{
+		route:     route,
+		transport: transport,
+		cache:     sharedMetadata,
+		multiline: newMultilineJoiner(),
+	}
+	if err := adapter.configureLogging(); err != nil {
+		return nil, err
+	}
+	built := false
+	defer func() {
+		if !built {
+			adapter.release()
+		}
+	}()
+	if _, err := ParseLogstashFields(os.Getenv("LOGSTASH_FIELDS")); err != nil {
+		return nil, errors.New("invalid LOGSTASH_FIELDS: " + err.Error())
+	}
+	if err := adapter.configureTimestamp(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configurePartials(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureSchema(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureFormat(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureDatagram(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureLevels(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureKubernetes(); err != nil {
+		return nil, errors.New("cannot watch kubernetes pods: " + err.Error())
+	}
+	if err := adapter.configureEviction(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureBatching(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureSpool(); err != nil {
+		return nil, errors.New("cannot open spool: " + err.Error())
+	}
+	if err := adapter.configureBacklog(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureReconnect(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureEndpoints(); err != nil {
+		return nil, err
+	}
+	if err := adapter.configureMetrics(); err != nil {
+		return nil, err
+	}
+
 	for {
 		client, err := docker.NewClientFromEnv()
 		if err != nil {
 			return nil, errors.New("cannot create docker client: " + err.Error())
 		}
 
-		conn, err := transport.Dial(route.Address, route.Options)
+		err = adapter.dialAll()
 
 		if err == nil {
-			return &LogstashAdapter{
-				route:          route,
-				conn:           conn,
-				containerTags:  make(map[string][]string),
-				logstashFields: make(map[string]map[string]string),
-				decodeJsonLogs: make(map[string]bool),
-				k8sLabels:      make(map[string]map[string]string),
-				client:         client,
-			}, nil
+			if err := adapter.registerMetrics(); err != nil {
+				return nil, err
+			}
+			adapter.client = client
+			built = true
+			return adapter, nil
 		}
 		if os.Getenv("RETRY_STARTUP") == "" {
 			return nil, err
 		}
-		log.Println("Retrying:", err)
+		adapter.log.warnf("could not connect, retrying: %s", err)
 		time.Sleep(2 * time.Second)
 	}
 }
 
-// Get container tags configured with the environment variable LOGSTASH_TAGS
-func GetContainerTags(c *docker.Container, a *LogstashAdapter) []string {
-	if tags, ok := a.containerTags[c.ID]; ok {
-		return tags
+// release stops what NewLogstashAdapter started for an adapter it couldn't
+// finish, so that the route can be created again.
+func (a *LogstashAdapter) release() {
+	if a.kubernetes != nil {
+		a.kubernetes.stop()
+	}
+	if a.backlog != nil {
+		a.backlog.Close()
 	}
+	for _, e := range a.endpoints {
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}
+}
 
-	tags := []string{}
-	tagsStr := os.Getenv("LOGSTASH_TAGS")
+// containerSetting returns the container label named label if it is set,
+// falling back to the container environment variable env and then to env in
+// logspout's own environment.
+func containerSetting(c *docker.Container, a *LogstashAdapter, label, env string) string {
+	if value, ok := lookupContainerSetting(c, a, label, env); ok {
+		return value
+	}
+	return os.Getenv(env)
+}
 
+// lookupContainerSetting is containerSetting without logspout's own
+// environment, for settings that only make sense per container.
+func lookupContainerSetting(c *docker.Container, a *LogstashAdapter, label, env string) (string, bool) {
+	if value, ok := settingLabels(c, a)[label]; ok {
+		return value, true
+	}
 	for _, e := range c.Config.Env {
-		if strings.HasPrefix(e, "LOGSTASH_TAGS=") {
-			tagsStr = strings.TrimPrefix(e, "LOGSTASH_TAGS=")
-			break
+		if strings.HasPrefix(e, env+"=") {
+			return strings.TrimPrefix(e, env+"="), true
 		}
 	}
+	return "", false
+}
 
-	if len(tagsStr) > 0 {
-		tags = strings.Split(tagsStr, ",")
+// settingLabels returns the labels of c that configure it. In Kubernetes,
+// where container labels can't be set, the logstash.* annotations of the
+// pod count as labels too. The pause container has them as labels prefixed
+// with "annotation.". Labels of the container itself win.
+func settingLabels(c *docker.Container, a *LogstashAdapter) map[string]string {
+	if _, ok := c.Config.Labels[K8S_POD_UID_LABEL]; !ok {
+		return c.Config.Labels
+	}
+	sandbox, err := GetPodSandboxLabels(c, a)
+	if err != nil {
+		a.log.with("container", c.ID).warnf("cannot get pod annotations: %s", err)
 	}
 
-	a.containerTags[c.ID] = tags
-	return tags
+	labels := make(map[string]string)
+	for k, v := range sandbox {
+		if strings.HasPrefix(k, K8S_SETTING_ANNOTATION_PREFIX) {
+			labels[strings.TrimPrefix(k, "annotation.")] = v
+		}
+	}
+	for k, v := range c.Config.Labels {
+		labels[k] = v
+	}
+	return labels
 }
 
-// Get logstash fields configured with the environment variable LOGSTASH_FIELDS
-func GetLogstashFields(c *docker.Container, a *LogstashAdapter) map[string]string {
-	if fields, ok := a.logstashFields[c.ID]; ok {
-		return fields
-	}
+// Get container tags configured with the label logstash.tags or the
+// environment variable LOGSTASH_TAGS
+func GetContainerTags(c *docker.Container, a *LogstashAdapter) []string {
+	tags, _ := a.metadata().get(c.ID, "tags", func() (interface{}, error) {
+		tags := []string{}
+		tagsStr := containerSetting(c, a, "logstash.tags", "LOGSTASH_TAGS")
 
-	fieldsStr := os.Getenv("LOGSTASH_FIELDS")
-	fields := map[string]string{}
+		if len(tagsStr) > 0 {
+			tags = strings.Split(tagsStr, ",")
+		}
+		return tags, nil
+	})
+	return tags.([]string)
+}
 
-	for _, e := range c.Config.Env {
-		if strings.HasPrefix(e, "LOGSTASH_FIELDS=") {
-			fieldsStr = strings.TrimPrefix(e, "LOGSTASH_FIELDS=")
+// Get logstash fields configured with the label logstash.fields or the
+// environment variable LOGSTASH_FIELDS. Labels named logstash.fields.<name>
+// add or replace single fields. A container whose fields can't be parsed is
+// reported once and gets none.
+func GetLogstashFields(c *docker.Container, a *LogstashAdapter) map[string]interface{} {
+	fields, _ := a.metadata().get(c.ID, "fields", func() (interface{}, error) {
+		fields, err := parseContainerFields(c, a)
+		if err != nil {
+			a.log.with("container", c.ID).warnf("ignoring LOGSTASH_FIELDS of %s: %s", c.Name, err)
+			return map[string]interface{}{}, nil
 		}
-	}
+		return fields, nil
+	})
+	return fields.(map[string]interface{})
+}
+
+func parseContainerFields(c *docker.Container, a *LogstashAdapter) (map[string]interface{}, error) {
+	fieldsStr := containerSetting(c, a, "logstash.fields", "LOGSTASH_FIELDS")
 
-	if len(fieldsStr) > 0 {
-		for _, f := range strings.Split(fieldsStr, ",") {
-			sp := strings.Split(f, "=")
-			k, v := sp[0], sp[1]
-			fields[k] = v
+	// each field label is parsed as if it was added to the list, so that
+	// its name can be typed and nested too
+	labels := settingLabels(c, a)
+	var names []string
+	for label := range labels {
+		if strings.HasPrefix(label, "logstash.fields.") {
+			names = append(names, label)
 		}
 	}
+	sort.Strings(names)
+	for _, label := range names {
+		fieldsStr += "," + strings.TrimPrefix(label, "logstash.fields.") + "=" + fieldValueEscaper.Replace(labels[label])
+	}
 
-	a.logstashFields[c.ID] = fields
-
-	return fields
+	return ParseLogstashFields(fieldsStr)
 }
 
+// fieldValueEscaper escapes a value for a list of fields.
+var fieldValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `,`, `\,`)
+
 func SelectContainerLabels(source map[string]string) map[string]string {
 	result := make(map[string]string)
 
@@ -159,36 +332,61 @@ func Merge(m1, m2 map[string]string) map[string]string {
 	return m2
 }
 
+// GetDockerLabels returns the name and version of the Docker host, which
+// are looked up once. The result must not be modified.
 func GetDockerLabels(a *LogstashAdapter) map[string]string {
-	info, err := a.client.Info()
-	if err != nil {
-		log.Print("Cannot get Docker info: ", err)
-		return nil
-	}
+	labels, _ := a.metadata().getHost("docker", func() (interface{}, error) {
+		info, err := a.client.Info()
+		if err != nil {
+			a.log.errorf("cannot get docker info: %s", err)
+			return nil, nil
+		}
 
-	labels := map[string]string{
-		"host":           info.Name,
-		"docker_version": info.ServerVersion,
+		labels := map[string]string{
+			"host":           info.Name,
+			"docker_version": info.ServerVersion,
+		}
+		return labels, nil
+	})
+	if labels == nil {
+		return nil
 	}
-	return labels
+	return labels.(map[string]string)
 }
 
 func GetPodLabels(c *docker.Container, current_labels map[string]string, a *LogstashAdapter) (map[string]string, error) {
-	if labels, ok := a.k8sLabels[c.ID]; ok {
-		debug("Got labels already for container %s", c.ID)
-		return labels, nil
-	}
-
-	debug("Looking for labels for container %s for the first time", c.ID)
-
 	// only mutate if the pod uid label exists (it's not an error if the label doesn't exist)
 	if _, ok := c.Config.Labels[K8S_POD_UID_LABEL]; !ok {
-		debug("There are no K8S labels for container %s", c.ID)
+		a.log.with("container", c.ID).debugf("there are no kubernetes labels")
 		return current_labels, nil
 	}
 
-	debug("Container %s is in a K8S pod", c.ID)
+	labels, err := a.metadata().get(c.ID, "k8sLabels", func() (interface{}, error) {
+		a.log.with("container", c.ID).debugf("container is in a kubernetes pod")
 
+		sandbox, err := findPodSandbox(c, a)
+		if err != nil || sandbox == nil {
+			return nil, err
+		}
+
+		labels := Merge(SelectContainerLabels(sandbox.Labels), current_labels)
+		labels = Merge(GetDockerLabels(a), labels)
+		a.log.with("container", c.ID).debugf("returning labels: %v", labels)
+		return labels, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if labels == nil {
+		a.log.with("container", c.ID).debugf("returning current labels %v, could not find a pod sandbox to match", current_labels)
+		return current_labels, nil
+	}
+	return labels.(map[string]string), nil
+}
+
+// findPodSandbox returns the pause container of the Kubernetes pod that c
+// belongs to, or nil if it can't be found.
+func findPodSandbox(c *docker.Container, a *LogstashAdapter) (*docker.APIContainers, error) {
 	// find parent container
 	fltr := K8S_POD_UID_LABEL + "=" + c.Config.Labels[K8S_POD_UID_LABEL]
 	opts := docker.ListContainersOptions{
@@ -199,144 +397,290 @@ func GetPodLabels(c *docker.Container, current_labels map[string]string, a *Logs
 		return nil, err
 	}
 
-	debug("Got some containers to check: %v", containers)
+	a.log.with("container", c.ID).debugf("got some containers to check: %v", containers)
 
-	for _, ctr := range containers {
+	for i, ctr := range containers {
 		if ctr.Labels[K8S_POD_UID_LABEL] == c.Config.Labels[K8S_POD_UID_LABEL] && ctr.Labels[K8S_POD_TYPE_LABEL] == K8S_POD_PARENT_TYPE {
-			debug("Container %s is a pod leader", ctr.ID)
-			a.k8sLabels[c.ID] = Merge(SelectContainerLabels(ctr.Labels), current_labels)
-			a.k8sLabels[c.ID] = Merge(GetDockerLabels(a), a.k8sLabels[c.ID])
-			debug("Returning labels: %v\n", a.k8sLabels[c.ID])
-			return a.k8sLabels[c.ID], nil
+			a.log.with("container", ctr.ID).debugf("container is a pod leader")
+			return &containers[i], nil
 		} else {
-			debug("Container %s is not a pod leader", ctr.ID)
+			a.log.with("container", ctr.ID).debugf("container is not a pod leader")
 		}
 	}
 
-	debug("Returning current_labels %v -- could not find a container to match", current_labels)
-
-	return current_labels, nil
+	return nil, nil
 }
 
 // Get boolean indicating whether json logs should be decoded (or added as message),
-// configured with the environment variable DECODE_JSON_LOGS
+// configured with the label logstash.decode_json or the environment variable
+// DECODE_JSON_LOGS
 func IsDecodeJsonLogs(c *docker.Container, a *LogstashAdapter) bool {
-	if decodeJsonLogs, ok := a.decodeJsonLogs[c.ID]; ok {
-		return decodeJsonLogs
+	decodeJsonLogs, _ := a.metadata().get(c.ID, "decodeJson", func() (interface{}, error) {
+		return containerSetting(c, a, "logstash.decode_json", "DECODE_JSON_LOGS") != "false", nil
+	})
+	return decodeJsonLogs.(bool)
+}
+
+// Stream implements the router.LogAdapter interface.
+func (a *LogstashAdapter) Stream(logstream chan *router.Message) {
+	if a.metrics == nil {
+		a.metrics = new(adapterMetrics)
 	}
+	a.startWriter()
+	defer a.stopWriter()
+	defer a.unregisterMetrics()
 
-	decodeJsonLogsStr := os.Getenv("DECODE_JSON_LOGS")
+	if a.partials == nil {
+		a.partials = newPartialJoiner(DefaultPartialSize, DefaultPartialMaxBytes, DefaultPartialTimeout)
+	}
+	if a.multiline == nil {
+		a.multiline = newMultilineJoiner()
+	}
+	ticker := time.NewTicker(joinTick)
+	defer ticker.Stop()
+	sweep := time.NewTicker(cacheSweepInterval)
+	defer sweep.Stop()
+	events, unwatch := a.watchContainers()
+	defer unwatch()
+	var eventsDropped bool
 
-	for _, e := range c.Config.Env {
-		if strings.HasPrefix(e, "DECODE_JSON_LOGS=") {
-			decodeJsonLogsStr = strings.TrimPrefix(e, "DECODE_JSON_LOGS=")
+	for {
+		select {
+		case m, ok := <-logstream:
+			if !ok {
+				// containers that died before the stream ended go first
+				for len(events) > 0 {
+					a.containerEvent(<-events)
+				}
+				a.flushJoined(func(time.Time) bool { return true })
+				return
+			}
+			if !a.acceptMessage(m) {
+				continue
+			}
+			a.reassemble(m)
+		case now := <-ticker.C:
+			a.flushJoined(now.After)
+		case now := <-sweep.C:
+			a.sweepContainers(now)
+		case ev, ok := <-events:
+			if !ok {
+				a.log.warnf("docker events stopped, relying on cache_ttl")
+				events = nil
+				continue
+			}
+			// warn once each time the channel fills up
+			if full := eventsFull(events); full && !eventsDropped {
+				a.log.warnf("docker events may have been dropped, relying on cache_ttl")
+				eventsDropped = true
+			} else if !full {
+				eventsDropped = false
+			}
+			a.containerEvent(ev)
 		}
 	}
+}
 
-	decodeJsonLogs := decodeJsonLogsStr != "false"
-
-	a.decodeJsonLogs[c.ID] = decodeJsonLogs
+// flushJoined sends the partly joined events whose deadline flush returns
+// true for, first partial messages and then multiline events.
+func (a *LogstashAdapter) flushJoined(flush func(deadline time.Time) bool) {
+	a.flushPartials(flush)
+	a.flushMultiline(flush)
+}
 
-	return decodeJsonLogs
+// flushContainer sends the partly joined events of a container, first
+// partial messages and then multiline events.
+func (a *LogstashAdapter) flushContainer(id string) {
+	prefix := id + "/"
+	if a.partials != nil {
+		for key := range a.partials.buffers {
+			if strings.HasPrefix(key, prefix) {
+				a.sendPartial(key, false)
+			}
+		}
+	}
+	if a.multiline != nil {
+		for key := range a.multiline.buffers {
+			if strings.HasPrefix(key, prefix) {
+				a.sendMultiline(key)
+			}
+		}
+	}
 }
 
-// Stream implements the router.LogAdapter interface.
-func (a *LogstashAdapter) Stream(logstream chan *router.Message) {
+// splitLines splits a message into log lines and passes them on to be joined.
+func (a *LogstashAdapter) splitLines(m *router.Message, data string, tags []string) {
+	// For some Docker versions (18.6, 18.9 at least), the journald
+	// driver doesn't separate long messages properly, and you get two log
+	// events concatenated with a single carriage return
+	if IsBrokenJournald(m.Container, a) && strings.Index(data, "\r") >= 0 {
+		for _, msg := range strings.Split(data, "\r") {
+			if len(msg) > 0 {
+				a.joinLine(m, msg, tags)
+			}
+		}
+		return
+	}
+	a.joinLine(m, data, tags)
+}
 
-	for m := range logstream {
+// sendLine annotates a log line of m's container with its Docker details,
+// tags and fields and sends it on. extraTags are added to the container's tags.
+func (a *LogstashAdapter) sendLine(m *router.Message, line string, extraTags []string) {
+	if !a.acceptLine(m, line) {
+		return
+	}
 
-		dockerInfo := DockerInfo{
-			Name:     m.Container.Name,
-			ID:       m.Container.ID,
-			Image:    m.Container.Config.Image,
-			Hostname: m.Container.Config.Hostname,
+	var meta map[string]interface{}
+	if a.schema == SchemaECS {
+		meta = GetECSFields(m.Container, a)
+	} else {
+		meta = map[string]interface{}{"docker": GetDockerInfo(m.Container, a)}
+		if kubernetes := GetKubernetesFields(m.Container, a); kubernetes != nil {
+			meta["kubernetes"] = kubernetes
 		}
+	}
 
-		if os.Getenv("DOCKER_LABELS") != "" {
-			labels := make(map[string]string)
-			for label, value := range m.Container.Config.Labels {
-				labels[strings.Replace(label, ".", "_", -1)] = value
-			}
+	tags := GetContainerTags(m.Container, a)
+	if len(extraTags) > 0 {
+		tags = append(append([]string{}, tags...), extraTags...)
+	}
+	fields := GetLogstashFields(m.Container, a)
+	parser := GetLineParser(m.Container, a)
 
-			labels, err := GetPodLabels(m.Container, labels, a)
-			if err != nil {
-				log.Fatal("Could not get pod labels: ", err)
-			}
+	a.sendMessage(m, line, meta, tags, fields, parser)
+}
 
-			dockerInfo.Labels = labels
+// GetDockerInfo returns the docker field of events in the default schema,
+// with the container's labels if DOCKER_LABELS is set.
+func GetDockerInfo(c *docker.Container, a *LogstashAdapter) DockerInfo {
+	dockerInfo := DockerInfo{
+		Name:     c.Name,
+		ID:       c.ID,
+		Image:    c.Config.Image,
+		Hostname: c.Config.Hostname,
+	}
+
+	if os.Getenv("DOCKER_LABELS") != "" {
+		labels := make(map[string]string)
+		for label, value := range c.Config.Labels {
+			labels[strings.Replace(label, ".", "_", -1)] = value
 		}
 
-		tags := GetContainerTags(m.Container, a)
-		fields := GetLogstashFields(m.Container, a)
-		decodeJson := IsDecodeJsonLogs(m.Container, a)
-
-		// For some Docker versions (18.6, 18.9 at least), the journald
-		// driver doesn't separate long messages properly, and you get two log
-		// events concatenated with a single carriage return
-		if os.Getenv("BROKEN_JOURNALD") != "" {
-			if strings.Index(m.Data, "\r") < 0 {
-				a.sendMessage(m.Source, m.Data, dockerInfo, tags, fields, decodeJson)
-			} else {
-				for _, msg := range strings.Split(m.Data, "\r") {
-					if len(msg) > 0 {
-						a.sendMessage(m.Source, msg, dockerInfo, tags, fields, decodeJson)
-					}
-				}
-			}
+		podLabels, err := GetPodLabels(c, labels, a)
+		if err != nil {
+			a.log.with("container", c.ID).errorf("could not get pod labels: %s", err)
 		} else {
-			a.sendMessage(m.Source, m.Data, dockerInfo, tags, fields, decodeJson)
+			labels = podLabels
 		}
+
+		dockerInfo.Labels = labels
 	}
+
+	return dockerInfo
 }
 
-func (a *LogstashAdapter) sendMessage(source, message string, dockerInfo DockerInfo, tags []string, fields map[string]string, decodeJson bool) {
+// sendMessage encodes a log line of m's container as an event and sends it.
+// The line is decoded into fields by the named parser, and lines that don't
+// match a grok pattern are tagged with GrokFailureTag. The fields in
+// meta describe where it came from and replace any fields of the same name.
+// With level detection on, the event also gets a normalised level.
+func (a *LogstashAdapter) sendMessage(m *router.Message, message string, meta map[string]interface{}, tags []string, fields map[string]interface{}, parser string) {
 	var js []byte
-	var data map[string]interface{}
 	var err error
 
-	debug("Sending a message: %s", message)
+	a.log.debugf("sending a message of container %s: %s", m.Container.ID, message)
 
-	// Try to parse JSON-encoded m.Data. If it wasn't JSON, create an empty object
-	// and use the original data as the message.
-	if decodeJson {
-		err = json.Unmarshal([]byte(message), &data)
-	}
-	if err != nil || data == nil {
-		data = make(map[string]interface{})
-		data["message"] = message
+	// Try to parse m.Data. If it can't be, use the original data as the
+	// message.
+	var data map[string]interface{}
+	if parser == ParserGrok {
+		var ok bool
+		if data, ok = a.grokLine(m.Container, message); !ok {
+			data = map[string]interface{}{"message": message}
+			tags = append(append([]string{}, tags...), GrokFailureTag)
+		}
+	} else {
+		data = a.parseLine(parser, message)
 	}
+	a.setLevel(data, m.Source)
+	mergeFields(data, fields)
 
-	for k, v := range fields {
+	for k, v := range meta {
 		data[k] = v
 	}
-
-	data["docker"] = dockerInfo
-	data["stream"] = source
+	data["stream"] = m.Source
 	data["tags"] = tags
-
-	// Return the JSON encoding
-	if js, err = json.Marshal(data); err != nil {
-		// Log error message and continue parsing next line, if marshalling fails
-		log.Println("logstash: could not marshal JSON:", err)
+	data["@version"] = "1"
+	data["@timestamp"] = a.eventTimestamp(m.Time, data)
+
+	// Return the encoded event
+	if js, err = a.encode(m, data); err != nil {
+		// Log error message and continue parsing next line, if encoding fails
+		a.log.with("container", m.Container.ID).errorf("could not encode event: %s", err)
+		a.metrics.encodeFailed()
+		return
+	}
+	var fits bool
+	if js, fits = a.fitDatagram(m, data, js); !fits {
 		return
 	}
 
-	// To work with tls and tcp transports via json_lines codec
-	js = append(js, byte('\n'))
+	a.metrics.containerEvent(m.Container.Name)
 
-	for {
-		_, err := a.conn.Write(js)
+	a.send(event{key: m.Container.ID, data: js})
+}
 
-		if err == nil {
-			break
+// configureTimestamp reads where the @timestamp of events comes from.
+func (a *LogstashAdapter) configureTimestamp() error {
+	a.timestampMode = getopt(a.route, "timestamp", "LOGSTASH_TIMESTAMP", TimestampDocker)
+	switch a.timestampMode {
+	case TimestampDocker, TimestampJson:
+		return nil
+	}
+	return errors.New("unknown timestamp mode: " + a.timestampMode)
+}
+
+// eventTimestamp returns the @timestamp for an event, formatted as RFC3339
+// with nanoseconds in UTC. Unless the adapter keeps JSON timestamps, this is
+// the time Docker read the log line.
+func (a *LogstashAdapter) eventTimestamp(t time.Time, data map[string]interface{}) string {
+	if a.timestampMode == TimestampJson {
+		for _, key := range JSON_TIMESTAMP_KEYS {
+			if ts, ok := parseTimestamp(data[key]); ok {
+				t = ts
+				break
+			}
 		}
+	}
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
 
-		if os.Getenv("RETRY_SEND") == "" {
-			log.Fatal("logstash: could not write:", err)
-		} else {
-			time.Sleep(2 * time.Second)
+// parseTimestamp accepts RFC3339 strings and numeric Unix epoch times. The
+// unit of numbers is told by their size: they are taken as seconds up to
+// 1e11, which is the year 5138, and as milliseconds, microseconds or
+// nanoseconds above that, as loggers such as pino write them.
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	switch ts := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		return t, err == nil
+	case float64:
+		if ts <= 0 {
+			return time.Time{}, false
+		}
+		whole, frac := math.Modf(ts)
+		n := int64(whole)
+		for _, unit := range []int64{1, 1e3, 1e6, 1e9} {
+			if ts < 1e11*float64(unit) {
+				return time.Unix(n/unit, n%unit*(1e9/unit)+int64(frac*1e9/float64(unit))), true
+			}
 		}
 	}
+	return time.Time{}, false
 }
 
 type DockerInfo struct {
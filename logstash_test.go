@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -52,6 +53,8 @@ func (m MockConn) SetWriteDeadline(t time.Time) error {
 
 type MockClient struct {
 	containers []*docker.Container
+	mu         sync.Mutex
+	listeners  []chan<- *docker.APIEvents
 }
 
 func (m *MockClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
@@ -85,18 +88,53 @@ func (m *MockClient) Info() (*docker.DockerInfo, error) {
 	return result, nil
 }
 
+func (m *MockClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, listener)
+	return nil
+}
+
+func (m *MockClient) RemoveEventListener(listener chan *docker.APIEvents) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, l := range m.listeners {
+		if l == listener {
+			m.listeners = append(m.listeners[:i], m.listeners[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// Emit sends an event to the listeners, waiting for one to be added first.
+// Like the Docker client, it drops the event for listeners that aren't ready
+// for it.
+func (m *MockClient) Emit(ev *docker.APIEvents) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		m.mu.Lock()
+		listeners := append([]chan<- *docker.APIEvents(nil), m.listeners...)
+		m.mu.Unlock()
+		if len(listeners) > 0 {
+			for _, l := range listeners {
+				select {
+				case l <- ev:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
+
 func TestStreamNullData(t *testing.T) {
 	assert := assert.New(t)
 
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -150,12 +188,8 @@ func TestStreamNotJsonWithoutLogstashTags(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -209,12 +243,8 @@ func TestStreamNotJsonWithLogstashTags(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -268,12 +298,8 @@ func TestStreamJsonWithoutLogstashTags(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -333,12 +359,8 @@ func TestStreamJsonWithLogstashTags(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -398,12 +420,8 @@ func TestStreamNotJsonWithLogstashFields(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -459,12 +477,8 @@ func TestStreamJsonWithLogstashFields(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -528,12 +542,8 @@ func TestStreamNotJsonWithLogstashFieldsWithDefault(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -591,12 +601,8 @@ func TestStreamJsonWithLogstashFieldsWithDefault(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -660,12 +666,8 @@ func TestStreamNotJsonWithLogstashTagsWithDefault(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -721,12 +723,8 @@ func TestStreamJsonWithLogstashTagsWithDefault(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -786,12 +784,8 @@ func TestStreamJsonWithLogstashFieldsAndBlacklist(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -856,12 +850,8 @@ func TestStreamJsonWithLogstashFieldsWithDefaultAndBlacklist(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -927,12 +917,8 @@ func TestStreamJsonLabelsDisabled(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -998,12 +984,8 @@ func TestStreamJsonLabelsEnabled(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -1076,12 +1058,8 @@ func TestStreamJsonLabelsEnabledButEmpty(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -1148,12 +1126,8 @@ func TestStreamJsonWithDecodeJsonLogsFalse(t *testing.T) {
 	conn := MockConn{}
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
 	}
 
 	assert.NotNil(adapter)
@@ -1231,9 +1205,9 @@ func TestStreamK8SPodNames(t *testing.T) {
 		"io.kubernetes.pod.uid":        "POD-UUID",
 		"io.kubernetes.docker.type":    "podsandbox",
 		"io.kubernetes.container.name": "POD",
-		"app":     "myapp",
-		"thingy":  "thangy",
-		"release": "bibbling-trouser",
+		"app":                          "myapp",
+		"thingy":                       "thangy",
+		"release":                      "bibbling-trouser",
 	}
 
 	parentContainerOpts := docker.CreateContainerOptions{
@@ -1245,13 +1219,9 @@ func TestStreamK8SPodNames(t *testing.T) {
 	client.CreateContainer(parentContainerOpts)
 
 	adapter := LogstashAdapter{
-		route:          new(router.Route),
-		conn:           conn,
-		containerTags:  make(map[string][]string),
-		logstashFields: make(map[string]map[string]string),
-		decodeJsonLogs: make(map[string]bool),
-		k8sLabels:      make(map[string]map[string]string),
-		client:         &client,
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
+		client:    &client,
 	}
 
 	assert.NotNil(adapter)
@@ -1317,3 +1287,197 @@ func TestStreamK8SPodNames(t *testing.T) {
 	assert.Equal("banana-potato", labels["host"])
 	assert.Equal("tangerine", labels["docker_version"])
 }
+
+func TestStreamTimestampFromMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := MockConn{}
+
+	adapter := LogstashAdapter{
+		route:     new(router.Route),
+		endpoints: []*endpoint{{conn: conn}},
+		client:    &MockClient{},
+	}
+
+	logstream := make(chan *router.Message)
+
+	containerConfig := docker.Config{}
+	containerConfig.Image = "image"
+	containerConfig.Hostname = "hostname"
+
+	container := docker.Container{}
+	container.Name = "name"
+	container.ID = "ID"
+	container.Config = &containerConfig
+
+	str := `{ "@timestamp": "2001-02-03T04:05:06Z", "message": "hello" }`
+
+	message := router.Message{
+		Container: &container,
+		Source:    "stdout",
+		Data:      str,
+		Time:      time.Date(2019, 5, 6, 7, 8, 9, 123456789, time.FixedZone("AEST", 10*60*60)),
+	}
+
+	go func() {
+		logstream <- &message
+		close(logstream)
+	}()
+
+	adapter.Stream(logstream)
+
+	var data map[string]interface{}
+	err := json.Unmarshal([]byte(res), &data)
+	assert.Nil(err)
+
+	assert.Equal("2019-05-05T21:08:09.123456789Z", data["@timestamp"])
+	assert.Equal("1", data["@version"])
+	assert.Equal("hello", data["message"])
+}
+
+func TestStreamTimestampFromJson(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := MockConn{}
+
+	adapter := LogstashAdapter{
+		route:         new(router.Route),
+		endpoints:     []*endpoint{{conn: conn}},
+		client:        &MockClient{},
+		timestampMode: TimestampJson,
+	}
+
+	containerConfig := docker.Config{}
+	containerConfig.Image = "image"
+	containerConfig.Hostname = "hostname"
+
+	container := docker.Container{}
+	container.Name = "name"
+	container.ID = "ID"
+	container.Config = &containerConfig
+
+	messageTime := time.Date(2019, 5, 6, 7, 8, 9, 0, time.UTC)
+
+	for str, expected := range map[string]string{
+		`{ "@timestamp": "2001-02-03T04:05:06.5+01:00" }`: "2001-02-03T03:05:06.5Z",
+		`{ "time": 981173106 }`:                           "2001-02-03T04:05:06Z",
+		`{ "time": 1700000000123 }`:                       "2023-11-14T22:13:20.123Z",
+		`{ "time": 1700000000123456 }`:                    "2023-11-14T22:13:20.123456Z",
+		`{ "time": -5 }`:                                  "2019-05-06T07:08:09Z",
+		`{ "timestamp": "yesterday" }`:                    "2019-05-06T07:08:09Z",
+		`not json`:                                        "2019-05-06T07:08:09Z",
+	} {
+		logstream := make(chan *router.Message)
+
+		message := router.Message{
+			Container: &container,
+			Source:    "stdout",
+			Data:      str,
+			Time:      messageTime,
+		}
+
+		go func() {
+			logstream <- &message
+			close(logstream)
+		}()
+
+		adapter.Stream(logstream)
+
+		var data map[string]interface{}
+		err := json.Unmarshal([]byte(res), &data)
+		assert.Nil(err)
+
+		assert.Equal(expected, data["@timestamp"], str)
+		assert.Equal("1", data["@version"])
+	}
+}
+
+func TestConfigureTimestamp(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{})}
+	assert.Nil(adapter.configureTimestamp())
+	assert.Equal(TimestampDocker, adapter.timestampMode)
+
+	adapter.route.Options["timestamp"] = "json"
+	assert.Nil(adapter.configureTimestamp())
+	assert.Equal(TimestampJson, adapter.timestampMode)
+
+	adapter.route.Options["timestamp"] = "jsn"
+	assert.NotNil(adapter.configureTimestamp())
+}
+
+func TestContainerSettingsFromLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("LOGSTASH_TAGS", "global")
+	defer os.Unsetenv("LOGSTASH_TAGS")
+
+	adapter := &LogstashAdapter{}
+	container := &docker.Container{ID: "labelled", Config: &docker.Config{
+		Env: []string{"LOGSTASH_TAGS=env", "LOGSTASH_FIELDS=a=env,b=env", "DECODE_JSON_LOGS=true"},
+		Labels: map[string]string{
+			"logstash.tags":           "label,tags",
+			"logstash.fields.b":       "label, with \"quotes\"",
+			"logstash.fields.c.d:int": "4",
+			"logstash.decode_json":    "false",
+			"logstash.exclude":        "true",
+		},
+	}}
+
+	// labels win over the container environment
+	assert.Equal([]string{"label", "tags"}, GetContainerTags(container, adapter))
+	assert.Equal(map[string]interface{}{
+		"a": "env",
+		"b": `label, with "quotes"`,
+		"c": map[string]interface{}{"d": int64(4)},
+	}, GetLogstashFields(container, adapter))
+	assert.False(IsDecodeJsonLogs(container, adapter))
+	assert.True(IsExcluded(container, adapter))
+
+	// which wins over logspout's own environment
+	container = &docker.Container{ID: "env", Config: &docker.Config{Env: []string{"LOGSTASH_TAGS=env"}}}
+	assert.Equal([]string{"env"}, GetContainerTags(container, adapter))
+	assert.False(IsExcluded(container, adapter))
+	container = &docker.Container{ID: "default", Config: &docker.Config{}}
+	assert.Equal([]string{"global"}, GetContainerTags(container, adapter))
+}
+
+func TestContainerSettingsFromPodAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &MockClient{}
+	client.CreateContainer(docker.CreateContainerOptions{Config: &docker.Config{Labels: map[string]string{
+		"io.kubernetes.pod.uid":                "POD-UUID",
+		"io.kubernetes.docker.type":            "podsandbox",
+		"annotation.logstash.tags":             "annotated",
+		"annotation.logstash.fields.team":      "payments",
+		"annotation.kubernetes.io/config.seen": "2019-01-01",
+	}}})
+	adapter := &LogstashAdapter{client: client}
+
+	container := &docker.Container{ID: "pod-container", Config: &docker.Config{Labels: map[string]string{
+		"io.kubernetes.pod.uid":     "POD-UUID",
+		"io.kubernetes.docker.type": "container",
+		"logstash.fields.team":      "container label",
+	}}}
+	assert.Equal([]string{"annotated"}, GetContainerTags(container, adapter))
+	assert.Equal(map[string]interface{}{"team": "container label"}, GetLogstashFields(container, adapter))
+}
+
+func TestStreamExcludedContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	container := docker.Container{ID: "excluded", Config: &docker.Config{Env: []string{"LOGSTASH_EXCLUDE=true"}}}
+
+	logstream := make(chan *router.Message)
+	go func() {
+		logstream <- &router.Message{Container: &container, Source: "stdout", Data: "hidden", Time: time.Now()}
+		close(logstream)
+	}()
+	adapter.Stream(logstream)
+
+	assert.Empty(conn.Writes())
+}
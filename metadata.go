@@ -0,0 +1,148 @@
+package logstash
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// sharedMetadata is the metadata cache of every adapter, so that routes
+// sending the same containers to different places look them up only once.
+var sharedMetadata = newMetadataCache()
+
+// CacheStats counts how often metadata was found in the cache.
+type CacheStats struct {
+	Hits       uint64
+	Misses     uint64
+	Containers int
+}
+
+// metadataCache holds what was looked up about each container, such as its
+// tags and labels, and about the Docker host. It is safe for concurrent use,
+// and a value being looked up is waited for rather than looked up again.
+type metadataCache struct {
+	mu         sync.Mutex
+	containers map[string]*containerMetadata
+	host       map[string]*cachedValue
+	hits       uint64
+	misses     uint64
+}
+
+// containerMetadata holds the values of one container, by kind.
+type containerMetadata struct {
+	values map[string]*cachedValue
+	used   time.Time
+}
+
+type cachedValue struct {
+	ready chan struct{} // closed once value and err are set
+	value interface{}
+	err   error
+}
+
+func newMetadataCache() *metadataCache {
+	return &metadataCache{
+		containers: make(map[string]*containerMetadata),
+		host:       make(map[string]*cachedValue),
+	}
+}
+
+// metadata returns the cache the adapter looks containers up in. Adapters
+// not created by NewLogstashAdapter get their own.
+func (a *LogstashAdapter) metadata() *metadataCache {
+	if a.cache == nil {
+		a.cache = newMetadataCache()
+	}
+	return a.cache
+}
+
+// get returns the value of a kind for a container, calling load if it isn't
+// cached yet. Values are not cached if load fails or returns nil.
+func (c *metadataCache) get(id, kind string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	container, ok := c.containers[id]
+	if !ok {
+		container = &containerMetadata{values: make(map[string]*cachedValue)}
+		c.containers[id] = container
+	}
+	container.used = time.Now()
+	c.mu.Unlock()
+
+	return c.lookup(container.values, kind, load)
+}
+
+// getHost is get for values that describe the Docker host rather than a
+// container. They are never evicted.
+func (c *metadataCache) getHost(kind string, load func() (interface{}, error)) (interface{}, error) {
+	return c.lookup(c.host, kind, load)
+}
+
+func (c *metadataCache) lookup(values map[string]*cachedValue, kind string, load func() (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	if cached, ok := values[kind]; ok {
+		c.hits++
+		c.mu.Unlock()
+		<-cached.ready
+		return cached.value, cached.err
+	}
+	c.misses++
+	cached := &cachedValue{ready: make(chan struct{})}
+	values[kind] = cached
+	c.mu.Unlock()
+
+	cached.value, cached.err = load()
+	if cached.err != nil || cached.value == nil {
+		c.mu.Lock()
+		if values[kind] == cached {
+			delete(values, kind)
+		}
+		c.mu.Unlock()
+	}
+	close(cached.ready)
+	return cached.value, cached.err
+}
+
+// forget drops everything cached about a container.
+func (c *metadataCache) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.containers, id)
+}
+
+// sweep forgets containers that weren't looked up within ttl, and then the
+// least recently used ones beyond size. Zero turns either limit off.
+func (c *metadataCache) sweep(now time.Time, ttl time.Duration, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ttl > 0 {
+		for id, container := range c.containers {
+			if now.Sub(container.used) > ttl {
+				delete(c.containers, id)
+			}
+		}
+	}
+	if size > 0 && len(c.containers) > size {
+		ids := make([]string, 0, len(c.containers))
+		for id := range c.containers {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return c.containers[ids[i]].used.Before(c.containers[ids[j]].used) })
+		for _, id := range ids[:len(ids)-size] {
+			delete(c.containers, id)
+		}
+	}
+}
+
+// Stats returns the hit and miss counts of the cache and how many containers
+// it holds.
+func (c *metadataCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Containers: len(c.containers)}
+}
+
+// MetadataCacheStats returns the statistics of the cache shared by adapters.
+func MetadataCacheStats() CacheStats {
+	return sharedMetadata.Stats()
+}
@@ -0,0 +1,104 @@
+package logstash
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingClient is a MockClient that counts the calls to Info.
+type countingClient struct {
+	MockClient
+	infos int32
+}
+
+func (c *countingClient) Info() (*docker.DockerInfo, error) {
+	atomic.AddInt32(&c.infos, 1)
+	return c.MockClient.Info()
+}
+
+func TestMetadataCacheSharedByAdapters(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &countingClient{}
+	cache := newMetadataCache()
+	first := newBatchingAdapter("logstash+tcp", &recordingConn{})
+	second := newBatchingAdapter("logstash+udp", &recordingConn{})
+	for _, adapter := range []*LogstashAdapter{first, second} {
+		adapter.client = client
+		adapter.cache = cache
+	}
+
+	container := cachedContainer("ID")
+	assert.Equal([]string{"one"}, GetContainerTags(container, first))
+	assert.Equal([]string{"one"}, GetContainerTags(container, second))
+	assert.Equal("banana-potato", GetDockerHost(first))
+	assert.Equal("banana-potato", GetDockerHost(second))
+
+	assert.Equal(int32(1), atomic.LoadInt32(&client.infos))
+	assert.Equal(CacheStats{Hits: 2, Misses: 2, Containers: 1}, cache.Stats())
+}
+
+func TestMetadataCacheConcurrentLookups(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newMetadataCache()
+	var loads int32
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := cache.get("ID", "tags", func() (interface{}, error) {
+				atomic.AddInt32(&loads, 1)
+				<-release
+				return []string{"one"}, nil
+			})
+			assert.Nil(err)
+			assert.Equal([]string{"one"}, value)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// lookups of a value being loaded wait for it
+	assert.Equal(int32(1), loads)
+	assert.Equal(uint64(9), cache.Stats().Hits)
+	assert.Equal(uint64(1), cache.Stats().Misses)
+}
+
+func TestMetadataCacheRetriesFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newMetadataCache()
+	loads := 0
+	fail := func() (interface{}, error) {
+		loads++
+		return nil, errors.New("no such container")
+	}
+	missing := func() (interface{}, error) {
+		loads++
+		return nil, nil
+	}
+
+	_, err := cache.get("ID", "k8sLabels", fail)
+	assert.NotNil(err)
+	_, err = cache.get("ID", "k8sLabels", fail)
+	assert.NotNil(err)
+	value, err := cache.get("ID", "k8sLabels", missing)
+	assert.Nil(err)
+	assert.Nil(value)
+	cache.get("ID", "k8sLabels", missing)
+	assert.Equal(4, loads)
+
+	cache.forget("ID")
+	assert.Equal(0, cache.Stats().Containers)
+}
@@ -0,0 +1,300 @@
+package logstash
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultMetricsMaxContainers is the number of containers counted on their
+// own before the rest are counted together as "_other".
+const DefaultMetricsMaxContainers = 100
+
+// metricsOtherContainer labels the containers beyond the cardinality cap.
+const metricsOtherContainer = "_other"
+
+// metricsAdapters are the adapters whose metrics are exposed, and
+// metricsServers the addresses they're exposed on.
+var (
+	metricsMu       sync.Mutex
+	metricsAdapters []*LogstashAdapter
+	metricsServers  = make(map[string]bool)
+)
+
+// adapterMetrics counts what an adapter does, for the metrics endpoint. Its
+// methods do nothing for adapters that have none.
+type adapterMetrics struct {
+	maxContainers int
+	addr          string
+
+	mu         sync.Mutex
+	endpoints  map[string]*endpointMetrics // by address
+	containers map[string]*uint64          // events by container name
+
+	decodeFailures uint64
+	encodeErrors   uint64
+	oversized      uint64
+	oversizeDrops  uint64
+}
+
+type endpointMetrics struct {
+	events      uint64
+	bytes       uint64
+	writeErrors uint64
+}
+
+// configureMetrics reads how the adapter's metrics are counted and where
+// they are served, from metrics_addr or LOGSTASH_METRICS_ADDR.
+func (a *LogstashAdapter) configureMetrics() error {
+	a.metrics = new(adapterMetrics)
+	var err error
+	if a.metrics.maxContainers, err = getoptInt(a.route, "metrics_max_containers", "LOGSTASH_METRICS_MAX_CONTAINERS", DefaultMetricsMaxContainers); err != nil {
+		return err
+	}
+	a.metrics.addr = getopt(a.route, "metrics_addr", "LOGSTASH_METRICS_ADDR", "")
+	return nil
+}
+
+// registerMetrics exposes the metrics of an adapter that was created, and
+// serves them unless that's already done for another route.
+func (a *LogstashAdapter) registerMetrics() error {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if addr := a.metrics.addr; addr != "" && !metricsServers[addr] {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return errors.New("cannot serve metrics: " + err.Error())
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", serveMetrics)
+		go func() {
+			a.log.errorf("metrics stopped: %s", http.Serve(l, mux))
+		}()
+		metricsServers[addr] = true
+	}
+	metricsAdapters = append(metricsAdapters, a)
+	return nil
+}
+
+// unregisterMetrics stops exposing the metrics of an adapter whose stream
+// has ended.
+func (a *LogstashAdapter) unregisterMetrics() {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for i, registered := range metricsAdapters {
+		if registered == a {
+			metricsAdapters = append(metricsAdapters[:i:i], metricsAdapters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *adapterMetrics) endpoint(address string) *endpointMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.endpoints == nil {
+		m.endpoints = make(map[string]*endpointMetrics)
+	}
+	e := m.endpoints[address]
+	if e == nil {
+		e = new(endpointMetrics)
+		m.endpoints[address] = e
+	}
+	return e
+}
+
+// written counts events written to an endpoint.
+func (m *adapterMetrics) written(address string, events []event) {
+	if m == nil {
+		return
+	}
+	e := m.endpoint(address)
+	size := 0
+	for _, ev := range events {
+		size += len(ev.data)
+	}
+	atomic.AddUint64(&e.events, uint64(len(events)))
+	atomic.AddUint64(&e.bytes, uint64(size))
+}
+
+// writeFailed counts a failed write to an endpoint.
+func (m *adapterMetrics) writeFailed(address string) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.endpoint(address).writeErrors, 1)
+}
+
+// containerEvent counts an event of a container. Containers beyond the cap
+// are counted together.
+func (m *adapterMetrics) containerEvent(name string) {
+	if m == nil {
+		return
+	}
+	name = strings.TrimPrefix(name, "/")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.containers == nil {
+		m.containers = make(map[string]*uint64)
+	}
+	n := m.containers[name]
+	if n == nil {
+		max := m.maxContainers
+		if max == 0 {
+			max = DefaultMetricsMaxContainers
+		}
+		if len(m.containers) >= max {
+			name = metricsOtherContainer
+			n = m.containers[name]
+		}
+		if n == nil {
+			n = new(uint64)
+			m.containers[name] = n
+		}
+	}
+	*n++
+}
+
+// decodeFailed counts a line that looked like JSON but couldn't be decoded.
+func (m *adapterMetrics) decodeFailed() {
+	if m != nil {
+		atomic.AddUint64(&m.decodeFailures, 1)
+	}
+}
+
+// encodeFailed counts an event that couldn't be encoded.
+func (m *adapterMetrics) encodeFailed() {
+	if m != nil {
+		atomic.AddUint64(&m.encodeErrors, 1)
+	}
+}
+
+// oversizedEvent counts an event too large for a datagram.
+func (m *adapterMetrics) oversizedEvent() {
+	if m != nil {
+		atomic.AddUint64(&m.oversized, 1)
+	}
+}
+
+// oversizeDropped counts an event dropped because it couldn't be made to fit
+// in a datagram.
+func (m *adapterMetrics) oversizeDropped() {
+	if m != nil {
+		atomic.AddUint64(&m.oversizeDrops, 1)
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	adapters := append([]*LogstashAdapter(nil), metricsAdapters...)
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, adapters)
+}
+
+// metricFamily is a metric and its samples in the Prometheus text format.
+type metricFamily struct {
+	name, kind, help string
+	samples          []string
+}
+
+func (f *metricFamily) add(value uint64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(f.name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i] + `="` + metricLabelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(&b, " %d", value)
+	f.samples = append(f.samples, b.String())
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the metrics of the adapters, labelled with their route
+// and transport, and those of the metadata cache they share.
+func writeMetrics(w io.Writer, adapters []*LogstashAdapter) {
+	sent := &metricFamily{name: "logstash_events_sent_total", kind: "counter", help: "Events written to an endpoint."}
+	bytes := &metricFamily{name: "logstash_bytes_sent_total", kind: "counter", help: "Bytes of events written to an endpoint."}
+	writeErrors := &metricFamily{name: "logstash_write_errors_total", kind: "counter", help: "Writes to an endpoint that failed and are retried."}
+	containers := &metricFamily{name: "logstash_container_events_total", kind: "counter", help: "Events of a container, with containers beyond the cap counted as _other."}
+	decodeFailures := &metricFamily{name: "logstash_json_decode_failures_total", kind: "counter", help: "Lines that looked like JSON objects but could not be decoded."}
+	encodeErrors := &metricFamily{name: "logstash_encode_errors_total", kind: "counter", help: "Events that could not be encoded and were dropped."}
+	oversized := &metricFamily{name: "logstash_oversized_events_total", kind: "counter", help: "Events too large for a datagram, which were compressed or truncated."}
+	dropped := &metricFamily{name: "logstash_events_dropped_total", kind: "counter", help: "Events or lines dropped, by reason."}
+
+	for _, a := range adapters {
+		route, transport := "", ""
+		if a.route != nil {
+			route, transport = a.route.ID, a.route.AdapterTransport("udp")
+		}
+		labels := []string{"route", route, "transport", transport}
+
+		if m := a.metrics; m != nil {
+			m.mu.Lock()
+			addresses := make([]string, 0, len(m.endpoints))
+			for address := range m.endpoints {
+				addresses = append(addresses, address)
+			}
+			sort.Strings(addresses)
+			for _, address := range addresses {
+				e := m.endpoints[address]
+				endpoint := append(labels, "destination", address)
+				sent.add(atomic.LoadUint64(&e.events), endpoint...)
+				bytes.add(atomic.LoadUint64(&e.bytes), endpoint...)
+				writeErrors.add(atomic.LoadUint64(&e.writeErrors), endpoint...)
+			}
+			names := make([]string, 0, len(m.containers))
+			for name := range m.containers {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				containers.add(*m.containers[name], append(labels, "container", name)...)
+			}
+			m.mu.Unlock()
+
+			decodeFailures.add(atomic.LoadUint64(&m.decodeFailures), labels...)
+			encodeErrors.add(atomic.LoadUint64(&m.encodeErrors), labels...)
+			oversized.add(atomic.LoadUint64(&m.oversized), labels...)
+			dropped.add(atomic.LoadUint64(&m.oversizeDrops), append(labels, "reason", "oversized")...)
+		}
+		filtered := a.FilterStats()
+		var backlogged uint64
+		if a.backlog != nil {
+			backlogged = a.backlog.Dropped()
+		}
+		dropped.add(backlogged, append(labels, "reason", "backlog_full")...)
+		dropped.add(filtered.Disabled, append(labels, "reason", "disabled")...)
+		dropped.add(filtered.Stream, append(labels, "reason", "stream")...)
+		dropped.add(filtered.Excluded, append(labels, "reason", "excluded")...)
+	}
+
+	cache := MetadataCacheStats()
+	hits := &metricFamily{name: "logstash_metadata_cache_hits_total", kind: "counter", help: "Container settings and metadata found in the cache."}
+	hits.add(cache.Hits)
+	misses := &metricFamily{name: "logstash_metadata_cache_misses_total", kind: "counter", help: "Container settings and metadata looked up, from Docker or Kubernetes where needed."}
+	misses.add(cache.Misses)
+	cached := &metricFamily{name: "logstash_metadata_cache_containers", kind: "gauge", help: "Containers in the metadata cache."}
+	cached.add(uint64(cache.Containers))
+
+	for _, f := range []*metricFamily{sent, bytes, writeErrors, containers, decodeFailures, encodeErrors, oversized, dropped, hits, misses, cached} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, sample := range f.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
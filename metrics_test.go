@@ -0,0 +1,129 @@
+package logstash
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.route.ID = "abc123"
+	streamLines(adapter, `{"message": "ok"}`, `{"broken": `, "plain")
+	streamSourcedLines(adapter, &docker.Container{ID: "quiet", Name: "/quiet", Config: &docker.Config{
+		Labels: map[string]string{"logstash.streams": "stderr"},
+	}}, stdoutLines("dropped")...)
+
+	var out bytes.Buffer
+	writeMetrics(&out, []*LogstashAdapter{adapter})
+	metrics := out.String()
+
+	route := `route="abc123",transport="tcp"`
+	assert.Contains(metrics, "# TYPE logstash_events_sent_total counter\n")
+	assert.Contains(metrics, `logstash_events_sent_total{`+route+`,destination="logstash:5000"} 3`+"\n")
+	assert.Contains(metrics, `logstash_bytes_sent_total{`+route+`,destination="logstash:5000"} `+strconv.Itoa(len(conn.Writes()[0])))
+	assert.Contains(metrics, `logstash_write_errors_total{`+route+`,destination="logstash:5000"} 0`+"\n")
+	assert.Contains(metrics, `logstash_container_events_total{`+route+`,container="name"} 3`+"\n")
+	assert.Contains(metrics, `logstash_json_decode_failures_total{`+route+`} 1`+"\n")
+	assert.Contains(metrics, `logstash_encode_errors_total{`+route+`} 0`+"\n")
+	assert.Contains(metrics, `logstash_events_dropped_total{`+route+`,reason="stream"} 1`+"\n")
+	assert.Contains(metrics, `logstash_events_dropped_total{`+route+`,reason="backlog_full"} 0`+"\n")
+	assert.Contains(metrics, "# TYPE logstash_metadata_cache_containers gauge\n")
+	assert.Regexp(`(?m)^logstash_metadata_cache_hits_total \d+$`, metrics)
+}
+
+func TestMetricsWriteErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	conn.SetError(errors.New("connection refused"))
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.route.ID = "failing"
+	adapter.metrics = new(adapterMetrics)
+	adapter.writeBatch([]event{{key: "ID", data: []byte("x\n")}})
+
+	var out bytes.Buffer
+	writeMetrics(&out, []*LogstashAdapter{adapter})
+	assert.Contains(out.String(), `logstash_write_errors_total{route="failing",transport="tcp",destination="logstash:5000"} 1`+"\n")
+}
+
+func TestMetricsContainerCap(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{
+		route:   &router.Route{ID: "capped", Adapter: "logstash"},
+		metrics: &adapterMetrics{maxContainers: 2},
+	}
+	for _, name := range []string{"/a", "/b", "/c", "/a", "/d"} {
+		adapter.metrics.containerEvent(name)
+	}
+
+	rec := httptest.NewRecorder()
+	metricsMu.Lock()
+	saved := metricsAdapters
+	metricsAdapters = []*LogstashAdapter{adapter}
+	metricsMu.Unlock()
+	serveMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	metricsMu.Lock()
+	metricsAdapters = saved
+	metricsMu.Unlock()
+
+	metrics := rec.Body.String()
+	assert.Contains(metrics, `logstash_container_events_total{route="capped",transport="udp",container="a"} 2`+"\n")
+	assert.Contains(metrics, `logstash_container_events_total{route="capped",transport="udp",container="b"} 1`+"\n")
+	assert.Contains(metrics, `logstash_container_events_total{route="capped",transport="udp",container="_other"} 2`+"\n")
+	assert.NotContains(metrics, `container="c"`)
+}
+
+func TestConfigureMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{"metrics_addr": "256.0.0.1:9102"})}
+	assert.Nil(adapter.configureMetrics())
+	assert.NotNil(adapter.registerMetrics())
+
+	adapter = &LogstashAdapter{route: newRoute(map[string]string{"metrics_max_containers": "many"})}
+	assert.NotNil(adapter.configureMetrics())
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	registered := func(a *LogstashAdapter) bool {
+		metricsMu.Lock()
+		defer metricsMu.Unlock()
+		for _, r := range metricsAdapters {
+			if r == a {
+				return true
+			}
+		}
+		return false
+	}
+
+	// adapters that fail to start aren't exposed
+	route := &router.Route{Adapter: "logstash+elasticsearch", Address: "es:9200", Options: map[string]string{"es_scheme": "ftp"}}
+	_, err := NewLogstashAdapter(route)
+	assert.NotNil(err)
+	metricsMu.Lock()
+	for _, r := range metricsAdapters {
+		assert.NotEqual(route, r.route)
+	}
+	metricsMu.Unlock()
+
+	// and those that are stop being exposed once their stream ends
+	adapter := newBatchingAdapter("logstash+tcp", &recordingConn{})
+	assert.Nil(adapter.configureMetrics())
+	assert.Nil(adapter.registerMetrics())
+	assert.True(registered(adapter))
+	streamLines(adapter, "one")
+	assert.False(registered(adapter))
+}
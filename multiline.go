@@ -0,0 +1,188 @@
+package logstash
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for joining multiline events.
+const (
+	DefaultMultilineMaxLines = 500
+	DefaultMultilineMaxBytes = 1024 * 1024
+	DefaultMultilineTimeout  = 5 * time.Second
+)
+
+// How often Stream looks for partly joined events that have timed out.
+var joinTick = 100 * time.Millisecond
+
+// multilineConfig says how lines of a container are joined. As in Filebeat,
+// a line matches when pattern matches it, or when it doesn't and negate is
+// set. With match "after" a matching line is appended to the lines before
+// it; with match "before" lines are collected until one that doesn't match.
+type multilineConfig struct {
+	pattern  *regexp.Regexp
+	negate   bool
+	before   bool
+	maxLines int
+	maxBytes int
+	timeout  time.Duration
+}
+
+// multilineBuffer holds the lines of an event that is still being joined.
+type multilineBuffer struct {
+	message  *router.Message // message of the first line
+	lines    []string
+	tags     []string
+	bytes    int
+	deadline time.Time
+}
+
+// multilineJoiner keeps the events being joined for each container and
+// stream.
+type multilineJoiner struct {
+	buffers map[string]*multilineBuffer
+}
+
+func newMultilineJoiner() *multilineJoiner {
+	return &multilineJoiner{
+		buffers: make(map[string]*multilineBuffer),
+	}
+}
+
+// getMultilineConfig returns the multiline settings of a container, or nil if
+// its lines aren't joined. They're configured with the container labels
+// logstash.multiline.pattern, .negate, .match, .max_lines, .max_bytes and
+// .timeout, or the environment variables LOGSTASH_MULTILINE_PATTERN and so on.
+func getMultilineConfig(c *docker.Container, a *LogstashAdapter) *multilineConfig {
+	config, _ := a.metadata().get(c.ID, "multiline", func() (interface{}, error) {
+		config, err := parseMultilineConfig(c, a)
+		if err != nil {
+			a.log.with("container", c.ID).warnf("not joining lines: %s", err)
+		}
+		return config, nil
+	})
+	return config.(*multilineConfig)
+}
+
+func parseMultilineConfig(c *docker.Container, a *LogstashAdapter) (*multilineConfig, error) {
+	setting := func(name string) string {
+		return containerSetting(c, a, "logstash.multiline."+name, "LOGSTASH_MULTILINE_"+strings.ToUpper(name))
+	}
+
+	pattern := setting("pattern")
+	if pattern == "" {
+		return nil, nil
+	}
+
+	config := &multilineConfig{
+		maxLines: DefaultMultilineMaxLines,
+		maxBytes: DefaultMultilineMaxBytes,
+		timeout:  DefaultMultilineTimeout,
+	}
+
+	var err error
+	if config.pattern, err = regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	if negate := setting("negate"); negate != "" {
+		if config.negate, err = strconv.ParseBool(negate); err != nil {
+			return nil, errors.New("invalid negate: " + negate)
+		}
+	}
+	switch match := setting("match"); match {
+	case "", "after":
+	case "before":
+		config.before = true
+	default:
+		return nil, errors.New("invalid match: " + match)
+	}
+	for name, limit := range map[string]*int{"max_lines": &config.maxLines, "max_bytes": &config.maxBytes} {
+		if value := setting(name); value != "" {
+			if *limit, err = strconv.Atoi(value); err != nil || *limit < 1 {
+				return nil, errors.New("invalid " + name + ": " + value)
+			}
+		}
+	}
+	if timeout := setting("timeout"); timeout != "" {
+		if config.timeout, err = time.ParseDuration(timeout); err != nil || config.timeout <= 0 {
+			return nil, errors.New("invalid timeout: " + timeout)
+		}
+	}
+	return config, nil
+}
+
+// joinLine adds a line to the event being joined for its container and
+// stream, sending on events that are complete. Lines of containers without
+// multiline settings are sent straight away.
+func (a *LogstashAdapter) joinLine(m *router.Message, line string, tags []string) {
+	config := getMultilineConfig(m.Container, a)
+	if config == nil {
+		a.sendLine(m, line, tags)
+		return
+	}
+
+	key := m.Container.ID + "/" + m.Source
+	buffer := a.multiline.buffers[key]
+	matches := config.pattern.MatchString(line) != config.negate
+
+	if !config.before && !matches && buffer != nil {
+		a.sendMultiline(key)
+		buffer = nil
+	}
+	if buffer != nil && (len(buffer.lines) >= config.maxLines || buffer.bytes+1+len(line) > config.maxBytes) {
+		a.sendMultiline(key)
+		buffer = nil
+	}
+	if buffer == nil {
+		buffer = &multilineBuffer{message: m}
+		a.multiline.buffers[key] = buffer
+	}
+
+	buffer.lines = append(buffer.lines, line)
+	buffer.bytes += len(line) + 1
+	for _, tag := range tags {
+		if !hasTag(buffer.tags, tag) {
+			buffer.tags = append(buffer.tags, tag)
+		}
+	}
+	buffer.deadline = time.Now().Add(config.timeout)
+
+	if config.before && !matches {
+		a.sendMultiline(key)
+	}
+}
+
+// sendMultiline sends the event joined so far for key.
+func (a *LogstashAdapter) sendMultiline(key string) {
+	buffer := a.multiline.buffers[key]
+	delete(a.multiline.buffers, key)
+	a.sendLine(buffer.message, strings.Join(buffer.lines, "\n"), buffer.tags)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// flushMultiline sends the partly joined events whose deadline flush returns
+// true for.
+func (a *LogstashAdapter) flushMultiline(flush func(deadline time.Time) bool) {
+	if a.multiline == nil {
+		return
+	}
+	for key, buffer := range a.multiline.buffers {
+		if flush(buffer.deadline) {
+			a.sendMultiline(key)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package logstash
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func multilineContainer(labels map[string]string) *docker.Container {
+	return &docker.Container{
+		Name:   "name",
+		ID:     "ID",
+		Config: &docker.Config{Image: "image", Hostname: "hostname", Labels: labels},
+	}
+}
+
+func sentMessages(t *testing.T, conn *recordingConn) []string {
+	var result []string
+	for _, write := range conn.Writes() {
+		result = append(result, messages(t, write)...)
+	}
+	return result
+}
+
+func TestMultilineContinuationLines(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	container := multilineContainer(map[string]string{"logstash.multiline.pattern": `^\s`})
+
+	streamSourcedLines(adapter, container, stdoutLines(
+		"Exception in thread \"main\" java.lang.NullPointerException",
+		"    at com.example.Book.getTitle(Book.java:16)",
+		"    at com.example.Author.getBookTitles(Author.java:25)",
+		"done")...)
+
+	assert.Equal([]string{
+		"Exception in thread \"main\" java.lang.NullPointerException\n    at com.example.Book.getTitle(Book.java:16)\n    at com.example.Author.getBookTitles(Author.java:25)",
+		"done",
+	}, sentMessages(t, conn))
+}
+
+func TestMultilineNegatedStartPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	container := multilineContainer(map[string]string{
+		"logstash.multiline.pattern": `^\d{4}-\d{2}-\d{2}`,
+		"logstash.multiline.negate":  "true",
+	})
+
+	streamSourcedLines(adapter, container, stdoutLines(
+		"2019-01-02 ERROR failed",
+		"Traceback (most recent call last):",
+		"ValueError: nope",
+		"2019-01-02 INFO ok")...)
+
+	assert.Equal([]string{
+		"2019-01-02 ERROR failed\nTraceback (most recent call last):\nValueError: nope",
+		"2019-01-02 INFO ok",
+	}, sentMessages(t, conn))
+}
+
+func TestMultilineMatchBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	container := multilineContainer(map[string]string{
+		"logstash.multiline.pattern": `\\$`,
+		"logstash.multiline.match":   "before",
+	})
+
+	streamSourcedLines(adapter, container, stdoutLines(`one \`, `two \`, "three", "four")...)
+
+	assert.Equal([]string{"one \\\ntwo \\\nthree", "four"}, sentMessages(t, conn))
+}
+
+func TestMultilineMaxLines(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	container := multilineContainer(map[string]string{
+		"logstash.multiline.pattern":   `^\s`,
+		"logstash.multiline.max_lines": "2",
+	})
+
+	streamSourcedLines(adapter, container, stdoutLines("a", " b", " c", " d")...)
+
+	assert.Equal([]string{"a\n b", " c\n d"}, sentMessages(t, conn))
+}
+
+func TestMultilineTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.queueSize = 0
+	container := multilineContainer(map[string]string{
+		"logstash.multiline.pattern": `^\s`,
+		"logstash.multiline.timeout": "10ms",
+	})
+
+	logstream := make(chan *router.Message)
+	done := make(chan struct{})
+	go func() {
+		adapter.Stream(logstream)
+		close(done)
+	}()
+
+	logstream <- &router.Message{Container: container, Source: "stdout", Data: "first", Time: time.Now()}
+	logstream <- &router.Message{Container: container, Source: "stdout", Data: " more", Time: time.Now()}
+	assert.Eventually(func() bool { return len(conn.Writes()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal([]string{"first\n more"}, sentMessages(t, conn))
+
+	close(logstream)
+	<-done
+}
+
+func TestMultilineInvalidConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	container := multilineContainer(map[string]string{"logstash.multiline.pattern": `(`})
+
+	streamSourcedLines(adapter, container, stdoutLines("a", " b")...)
+
+	assert.Equal([]string{"a", " b"}, sentMessages(t, conn))
+}
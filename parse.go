@@ -0,0 +1,222 @@
+package logstash
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Parsers that turn log lines into fields, selected per container.
+const (
+	// ParserNone sends lines as the message.
+	ParserNone = "none"
+	// ParserJSON decodes lines that are JSON objects.
+	ParserJSON = "json"
+	// ParserLogfmt decodes lines of space separated key=value pairs, as
+	// written by logrus and other logfmt loggers.
+	ParserLogfmt = "logfmt"
+	// ParserKV picks key=value pairs out of lines, keeping the line as the
+	// message.
+	ParserKV = "kv"
+	// ParserAuto decodes lines starting with '{' as JSON and others as
+	// logfmt.
+	ParserAuto = "auto"
+)
+
+// lineParsers decode a line into the fields of an event, or report that it
+// isn't in their format.
+var lineParsers = map[string]func(a *LogstashAdapter, line string) (map[string]interface{}, bool){
+	ParserNone:   func(a *LogstashAdapter, line string) (map[string]interface{}, bool) { return nil, false },
+	ParserJSON:   (*LogstashAdapter).parseJSON,
+	ParserLogfmt: func(a *LogstashAdapter, line string) (map[string]interface{}, bool) { return parseLogfmt(line) },
+	ParserKV:     func(a *LogstashAdapter, line string) (map[string]interface{}, bool) { return parseKV(line) },
+	ParserAuto:   (*LogstashAdapter).parseAuto,
+
+	ParserCommon:   accessParser(ParserCommon),
+	ParserCombined: accessParser(ParserCombined),
+	ParserNginx:    accessParser(ParserNginx),
+	ParserApache:   accessParser(ParserApache),
+}
+
+// GetLineParser returns the parser for the lines of a container, which is
+// configured with the label logstash.parser or the environment variable
+// LOGSTASH_PARSER. Without one, lines are matched against the container's
+// grok pattern if it has one, or parsed as its image's logs if detection is
+// on, and otherwise decoded as JSON unless JSON decoding is turned off.
+func GetLineParser(c *docker.Container, a *LogstashAdapter) string {
+	parser, _ := a.metadata().get(c.ID, "parser", func() (interface{}, error) {
+		parser := containerSetting(c, a, "logstash.parser", "LOGSTASH_PARSER")
+		if parser == "" {
+			if containerGrokPattern(c, a) != nil {
+				return ParserGrok, nil
+			}
+			if parser := detectParser(c, a); parser != "" {
+				return parser, nil
+			}
+			if !IsDecodeJsonLogs(c, a) {
+				return ParserNone, nil
+			}
+			return ParserJSON, nil
+		}
+		if parser == ParserGrok {
+			if containerGrokPattern(c, a) == nil {
+				a.log.with("container", c.ID).warnf("no grok pattern, decoding JSON")
+				return ParserJSON, nil
+			}
+			return parser, nil
+		}
+		if _, ok := lineParsers[parser]; !ok {
+			a.log.with("container", c.ID).warnf("unknown parser %s, decoding JSON", parser)
+			return ParserJSON, nil
+		}
+		return parser, nil
+	})
+	return parser.(string)
+}
+
+// parseLine decodes a line with the named parser, falling back to sending
+// it as the message.
+func (a *LogstashAdapter) parseLine(parser, line string) map[string]interface{} {
+	if parse, ok := lineParsers[parser]; ok {
+		if data, ok := parse(a, line); ok {
+			return data
+		}
+	}
+	return map[string]interface{}{"message": line}
+}
+
+func (a *LogstashAdapter) parseJSON(line string) (map[string]interface{}, bool) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &data); err != nil {
+		if strings.HasPrefix(strings.TrimSpace(line), "{") {
+			a.metrics.decodeFailed()
+		}
+		return nil, false
+	}
+	return data, data != nil
+}
+
+func (a *LogstashAdapter) parseAuto(line string) (map[string]interface{}, bool) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		if data, ok := a.parseJSON(line); ok {
+			return data, true
+		}
+	}
+	return parseLogfmt(line)
+}
+
+// parseLogfmt decodes a logfmt line, which is kept as the message unless it
+// has a message pair. Values may be double quoted, with Go escapes, and keys
+// without a value are true. Any text that isn't a pair or a key fails the
+// line, as do lines with fewer pairs than keys without a value, which are
+// more likely prose that happens to contain a pair.
+func parseLogfmt(line string) (map[string]interface{}, bool) {
+	data := map[string]interface{}{"message": line}
+	pairs, bare := 0, 0
+	for i := 0; ; {
+		for i < len(line) && isLogfmtSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			break
+		}
+
+		start := i
+		for i < len(line) && !isLogfmtSpace(line[i]) && line[i] != '=' {
+			if line[i] == '"' {
+				return nil, false
+			}
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil, false
+		}
+		if i == len(line) || line[i] != '=' {
+			data[key] = true
+			bare++
+			continue
+		}
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			end := closingQuote(line, i)
+			if end < 0 {
+				return nil, false
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, false
+			}
+			data[key] = value
+			i = end + 1
+			if i < len(line) && !isLogfmtSpace(line[i]) {
+				return nil, false
+			}
+		} else {
+			start = i
+			for i < len(line) && !isLogfmtSpace(line[i]) {
+				if line[i] == '"' {
+					return nil, false
+				}
+				i++
+			}
+			data[key] = line[start:i]
+		}
+		pairs++
+	}
+	return data, pairs > 0 && bare <= pairs
+}
+
+func isLogfmtSpace(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// closingQuote returns the index of the quote closing the one at start, or
+// -1 if there is none.
+func closingQuote(s string, start int) int {
+	for i := start + 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case s[start]:
+			return i
+		}
+	}
+	return -1
+}
+
+// kvPair matches a key=value pair at the start of a line or after a space,
+// comma or semicolon. Values may be quoted with double or single quotes.
+var kvPair = regexp.MustCompile(`(?:^|[\s,;])([\w.@-]+)=("(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'|[^\s,;]*)`)
+
+// kvUnescaper removes the escapes of single quoted values.
+var kvUnescaper = strings.NewReplacer(`\'`, `'`, `\\`, `\`)
+
+// parseKV picks the key=value pairs out of a line, which is kept as the
+// message. It fails lines without any pairs.
+func parseKV(line string) (map[string]interface{}, bool) {
+	matches := kvPair.FindAllStringSubmatch(line, -1)
+	if len(matches) == 0 {
+		return nil, false
+	}
+	data := map[string]interface{}{"message": line}
+	for _, match := range matches {
+		key, value := match[1], match[2]
+		switch {
+		case strings.HasPrefix(value, `"`):
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
+		case strings.HasPrefix(value, `'`):
+			value = kvUnescaper.Replace(value[1 : len(value)-1])
+		}
+		data[key] = value
+	}
+	return data, true
+}
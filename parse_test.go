@@ -0,0 +1,125 @@
+package logstash
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogfmt(t *testing.T) {
+	assert := assert.New(t)
+
+	line := `time="2023-04-05T06:07:08Z" level=info msg="started \"api\"\tok" dur=3ms url=/a?b=c verbose`
+	data, ok := parseLogfmt(line)
+	assert.True(ok)
+	assert.Equal(map[string]interface{}{
+		"message": line,
+		"time":    "2023-04-05T06:07:08Z",
+		"level":   "info",
+		"msg":     "started \"api\"\tok",
+		"dur":     "3ms",
+		"url":     "/a?b=c",
+		"verbose": true,
+	}, data)
+
+	data, ok = parseLogfmt(`empty= quoted=""`)
+	assert.True(ok)
+	assert.Equal(map[string]interface{}{"message": `empty= quoted=""`, "empty": "", "quoted": ""}, data)
+
+	// a message pair replaces the line
+	data, ok = parseLogfmt(`level=warn message="disk full" retry`)
+	assert.True(ok)
+	assert.Equal(map[string]interface{}{"message": "disk full", "level": "warn", "retry": true}, data)
+
+	for _, line := range []string{
+		"",
+		"just some words",
+		"Starting server on port=8080",
+		"user bob logged in from ip=10.0.0.1",
+		"connection reset, retrying in 5s attempt=2",
+		`msg="unterminated`,
+		`msg="x"y`,
+		`a=b"c`,
+		`=value`,
+		`msg="bad \q escape"`,
+	} {
+		_, ok := parseLogfmt(line)
+		assert.False(ok, line)
+	}
+}
+
+func TestParseKV(t *testing.T) {
+	assert := assert.New(t)
+
+	line := `user login failed user=bob, ip=10.0.0.1;reason="bad \"password\"" note='it\'s' path=/x`
+	data, ok := parseKV(line)
+	assert.True(ok)
+	assert.Equal(map[string]interface{}{
+		"message": line,
+		"user":    "bob",
+		"ip":      "10.0.0.1",
+		"reason":  `bad "password"`,
+		"note":    "it's",
+		"path":    "/x",
+	}, data)
+
+	_, ok = parseKV("no pairs here, a == b")
+	assert.False(ok)
+}
+
+func TestParseAuto(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	assert.Equal(map[string]interface{}{"a": float64(1)}, adapter.parseLine(ParserAuto, `{"a": 1}`))
+	assert.Equal(map[string]interface{}{"message": "level=warn", "level": "warn"}, adapter.parseLine(ParserAuto, `level=warn`))
+	assert.Equal(map[string]interface{}{"message": "Starting server on port=8080"}, adapter.parseLine(ParserAuto, "Starting server on port=8080"))
+	assert.Equal(map[string]interface{}{"message": "plain text"}, adapter.parseLine(ParserAuto, "plain text"))
+	assert.Equal(map[string]interface{}{"message": "level=warn"}, adapter.parseLine(ParserJSON, "level=warn"))
+	assert.Equal(map[string]interface{}{"message": `{"a": 1}`}, adapter.parseLine(ParserNone, `{"a": 1}`))
+}
+
+func TestGetLineParser(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{}
+	parser := func(id string, labels map[string]string, env ...string) string {
+		return GetLineParser(&docker.Container{ID: id, Config: &docker.Config{Labels: labels, Env: env}}, adapter)
+	}
+	assert.Equal(ParserJSON, parser("default", nil))
+	assert.Equal(ParserNone, parser("nojson", nil, "DECODE_JSON_LOGS=false"))
+	assert.Equal(ParserLogfmt, parser("logfmt", map[string]string{"logstash.parser": "logfmt"}, "LOGSTASH_PARSER=kv"))
+	assert.Equal(ParserKV, parser("kv", nil, "LOGSTASH_PARSER=kv"))
+	assert.Equal(ParserJSON, parser("unknown", map[string]string{"logstash.parser": "xml"}))
+
+	os.Setenv("LOGSTASH_PARSER", "auto")
+	defer os.Unsetenv("LOGSTASH_PARSER")
+	assert.Equal(ParserAuto, parser("global", nil))
+}
+
+func TestStreamLogfmt(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("LOGSTASH_PARSER", "logfmt")
+	defer os.Unsetenv("LOGSTASH_PARSER")
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash", conn)
+	streamLines(adapter, `level=info msg="x" dur=3ms stream=fake`, "not logfmt")
+
+	writes := conn.Writes()
+	assert.Len(writes, 2)
+	var data map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(writes[0]), &data))
+	assert.Equal("info", data["level"])
+	assert.Equal("x", data["msg"])
+	assert.Equal("3ms", data["dur"])
+	assert.Equal("stdout", data["stream"])
+	assert.Equal(`level=info msg="x" dur=3ms stream=fake`, data["message"])
+
+	assert.Nil(json.Unmarshal([]byte(writes[1]), &data))
+	assert.Equal("not logfmt", data["message"])
+}
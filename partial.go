@@ -0,0 +1,139 @@
+package logstash
+
+import (
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for reassembling log lines that Docker split into partial messages.
+const (
+	DefaultPartialSize     = 16 * 1024
+	DefaultPartialMaxBytes = 1024 * 1024
+	DefaultPartialTimeout  = time.Second
+)
+
+// PartialTag is added to events that were cut short because the reassembled
+// line would have been larger than the maximum size.
+var PartialTag = "partial"
+
+// partialJoiner reassembles log lines that Docker split into messages of
+// exactly size bytes, per container and stream.
+type partialJoiner struct {
+	size     int
+	maxBytes int
+	timeout  time.Duration
+	buffers  map[string]*partialBuffer
+}
+
+// partialBuffer holds the parts of a line that is still being reassembled.
+type partialBuffer struct {
+	message  *router.Message // message of the first part
+	parts    []string
+	bytes    int
+	cut      bool // the start of the line was sent on its own
+	deadline time.Time
+}
+
+func newPartialJoiner(size, maxBytes int, timeout time.Duration) *partialJoiner {
+	if maxBytes < size {
+		maxBytes = size
+	}
+	return &partialJoiner{
+		size:     size,
+		maxBytes: maxBytes,
+		timeout:  timeout,
+		buffers:  make(map[string]*partialBuffer),
+	}
+}
+
+// configurePartials reads the partial message settings for the adapter's
+// route. A partial size of zero turns reassembly off.
+func (a *LogstashAdapter) configurePartials() error {
+	size, err := getoptInt(a.route, "partial_size", "LOGSTASH_PARTIAL_SIZE", DefaultPartialSize)
+	if err != nil {
+		return err
+	}
+	maxBytes, err := getoptInt(a.route, "partial_max_bytes", "LOGSTASH_PARTIAL_MAX_BYTES", DefaultPartialMaxBytes)
+	if err != nil {
+		return err
+	}
+	timeout, err := getoptDuration(a.route, "partial_timeout", "LOGSTASH_PARTIAL_TIMEOUT", DefaultPartialTimeout)
+	if err != nil {
+		return err
+	}
+	a.partials = newPartialJoiner(size, maxBytes, timeout)
+	return nil
+}
+
+// Get boolean indicating whether messages of a container should be split on
+// carriage returns, configured with the container label logstash.broken_journald
+// or container environment variable BROKEN_JOURNALD
+func IsBrokenJournald(c *docker.Container, a *LogstashAdapter) bool {
+	splitCR, _ := a.metadata().get(c.ID, "splitCR", func() (interface{}, error) {
+		value, _ := lookupContainerSetting(c, a, "logstash.broken_journald", "BROKEN_JOURNALD")
+		return value != "" && value != "false", nil
+	})
+	return splitCR.(bool)
+}
+
+// reassemble collects the partial messages of a line until one that is
+// shorter than the partial size completes it, then passes the line on.
+// Logspout strips the trailing newline and passes on no partial metadata, so
+// a complete line of exactly the partial size is joined with the next one.
+func (a *LogstashAdapter) reassemble(m *router.Message) {
+	p := a.partials
+	key := m.Container.ID + "/" + m.Source
+	buffer := p.buffers[key]
+
+	if buffer == nil && (p.size == 0 || len(m.Data) != p.size) {
+		a.splitLines(m, m.Data, nil)
+		return
+	}
+
+	if buffer != nil && buffer.bytes+len(m.Data) > p.maxBytes {
+		a.sendPartial(key, true)
+		buffer = &partialBuffer{message: m, cut: true}
+		p.buffers[key] = buffer
+	}
+	if buffer == nil {
+		buffer = &partialBuffer{message: m}
+		p.buffers[key] = buffer
+	}
+
+	buffer.parts = append(buffer.parts, m.Data)
+	buffer.bytes += len(m.Data)
+	buffer.deadline = time.Now().Add(p.timeout)
+
+	if len(m.Data) != p.size {
+		a.sendPartial(key, false)
+	}
+}
+
+// sendPartial passes on the line reassembled so far for key, tagged as
+// partial if it is incomplete because of the size limit.
+func (a *LogstashAdapter) sendPartial(key string, cut bool) {
+	buffer := a.partials.buffers[key]
+	delete(a.partials.buffers, key)
+
+	var tags []string
+	if cut || buffer.cut {
+		tags = []string{PartialTag}
+	}
+	a.splitLines(buffer.message, strings.Join(buffer.parts, ""), tags)
+}
+
+// flushPartials passes on the partly reassembled lines whose deadline flush
+// returns true for.
+func (a *LogstashAdapter) flushPartials(flush func(deadline time.Time) bool) {
+	if a.partials == nil {
+		return
+	}
+	for key, buffer := range a.partials.buffers {
+		if flush(buffer.deadline) {
+			a.sendPartial(key, false)
+		}
+	}
+}
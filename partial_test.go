@@ -0,0 +1,116 @@
+package logstash
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// sentEvents returns the message and tags of every event written to conn.
+func sentEvents(t *testing.T, conn *recordingConn) (messages []string, tags [][]interface{}) {
+	for _, write := range conn.Writes() {
+		for _, line := range splitLines(write) {
+			var data map[string]interface{}
+			assert.Nil(t, json.Unmarshal([]byte(line), &data))
+			messages = append(messages, data["message"].(string))
+			tags = append(tags, data["tags"].([]interface{}))
+		}
+	}
+	return messages, tags
+}
+
+func TestPartialMessagesAreReassembled(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.partials = newPartialJoiner(4, 100, time.Hour)
+
+	streamSourcedLines(adapter, multilineContainer(nil),
+		sourcedLine{"stdout", "abcd"},
+		sourcedLine{"stderr", "1234"},
+		sourcedLine{"stdout", "efgh"},
+		sourcedLine{"stdout", "ij"},
+		sourcedLine{"stderr", "5"},
+		sourcedLine{"stdout", "short"})
+
+	messages, tags := sentEvents(t, conn)
+	assert.Equal([]string{"abcdefghij", "12345", "short"}, messages)
+	assert.Equal([][]interface{}{{}, {}, {}}, tags)
+}
+
+func TestPartialMessagesAreCutAtMaxBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.partials = newPartialJoiner(4, 8, time.Hour)
+
+	streamSourcedLines(adapter, multilineContainer(nil),
+		sourcedLine{"stdout", "abcd"},
+		sourcedLine{"stdout", "efgh"},
+		sourcedLine{"stdout", "ijkl"},
+		sourcedLine{"stdout", "mn"},
+		sourcedLine{"stdout", "next"})
+
+	messages, tags := sentEvents(t, conn)
+	assert.Equal([]string{"abcdefgh", "ijklmn", "next"}, messages)
+	assert.Equal([][]interface{}{{"partial"}, {"partial"}, {}}, tags)
+}
+
+func TestPartialMessageFlushedWhenStreamCloses(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.partials = newPartialJoiner(4, 100, time.Hour)
+
+	streamSourcedLines(adapter, multilineContainer(nil), sourcedLine{"stdout", "abcd"})
+
+	messages, tags := sentEvents(t, conn)
+	assert.Equal([]string{"abcd"}, messages)
+	assert.Equal([][]interface{}{{}}, tags)
+}
+
+func TestCompleteLineOfPartialSizeIsJoined(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.partials = newPartialJoiner(4, 100, time.Hour)
+
+	// There is no way to tell a complete line of the partial size from a part.
+	streamSourcedLines(adapter, multilineContainer(nil),
+		sourcedLine{"stdout", "done"},
+		sourcedLine{"stdout", "next"})
+
+	messages, _ := sentEvents(t, conn)
+	assert.Equal([]string{"donenext"}, messages)
+}
+
+func TestBrokenJournaldIsPerContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	os.Setenv("BROKEN_JOURNALD", "1")
+	defer os.Unsetenv("BROKEN_JOURNALD")
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+
+	streamSourcedLines(adapter, multilineContainer(nil), sourcedLine{"stdout", "one\rtwo"})
+
+	broken := multilineContainer(nil)
+	broken.ID = "broken"
+	broken.Config.Env = []string{"BROKEN_JOURNALD=1"}
+	streamSourcedLines(adapter, broken, sourcedLine{"stdout", "three\rfour\r"})
+
+	labelled := multilineContainer(map[string]string{"logstash.broken_journald": "true"})
+	labelled.ID = "labelled"
+	streamSourcedLines(adapter, labelled, sourcedLine{"stdout", "five\rsix"})
+
+	messages, _ := sentEvents(t, conn)
+	assert.Equal([]string{"one\rtwo", "three", "four", "five", "six"}, messages)
+}
@@ -0,0 +1,83 @@
+package logstash
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Defaults for reconnecting after a failed write.
+const (
+	DefaultReconnectBackoff    = time.Second
+	DefaultReconnectBackoffMax = time.Minute
+)
+
+var errNotConnected = errors.New("not connected")
+
+// configureReconnect reads the backoff settings used when redialing.
+func (a *LogstashAdapter) configureReconnect() error {
+	var err error
+	if a.backoffMin, err = getoptDuration(a.route, "reconnect_backoff", "LOGSTASH_RECONNECT_BACKOFF", DefaultReconnectBackoff); err != nil {
+		return err
+	}
+	if a.backoffMax, err = getoptDuration(a.route, "reconnect_backoff_max", "LOGSTASH_RECONNECT_BACKOFF_MAX", DefaultReconnectBackoffMax); err != nil {
+		return err
+	}
+	if a.backoffMax < a.backoffMin {
+		a.backoffMax = a.backoffMin
+	}
+	return nil
+}
+
+// connected makes sure there's a connection to the endpoint, redialing it
+// once the backoff since its last failure has passed.
+func (a *LogstashAdapter) connected(e *endpoint) error {
+	if e.conn != nil {
+		return nil
+	}
+	if a.transport == nil || time.Now().Before(e.nextDial) {
+		return errNotConnected
+	}
+
+	conn, err := a.transport.Dial(e.address, a.route.Options)
+	if err != nil {
+		a.retryLater(e)
+		a.log.with("destination", e.address).warnf("could not reconnect, retrying in %s: %s", e.nextDial.Sub(time.Now()).Round(time.Millisecond), err)
+		return err
+	}
+	a.log.with("destination", e.address).infof("reconnected")
+	e.conn = conn
+	return nil
+}
+
+// disconnect drops a connection that failed a write, taking the endpoint out
+// of rotation until it can be redialed.
+func (a *LogstashAdapter) disconnect(e *endpoint, err error) {
+	a.log.with("destination", e.address).warnf("could not write: %s", err)
+	a.metrics.writeFailed(e.address)
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+	a.retryLater(e)
+}
+
+// retryLater schedules the next dial with jittered exponential backoff.
+func (a *LogstashAdapter) retryLater(e *endpoint) {
+	if e.backoff == 0 {
+		e.backoff = a.backoffMin
+	} else {
+		e.backoff *= 2
+	}
+	if e.backoff > a.backoffMax {
+		e.backoff = a.backoffMax
+	}
+	// wait between half and all of the backoff so adapters don't redial in step
+	half := e.backoff / 2
+	e.nextDial = time.Now().Add(half + time.Duration(rand.Int63n(int64(half)+1)))
+}
+
+// connectionHealthy resets the backoff after a successful write.
+func (a *LogstashAdapter) connectionHealthy(e *endpoint) {
+	e.backoff = 0
+}
@@ -0,0 +1,122 @@
+package logstash
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockTransport hands out conn, or fails while err is set.
+type mockTransport struct {
+	mu    sync.Mutex
+	conn  net.Conn
+	err   error
+	dials int
+}
+
+func (t *mockTransport) Dial(addr string, options map[string]string) (net.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dials++
+	if t.err != nil {
+		return nil, t.err
+	}
+	return t.conn, nil
+}
+
+func (t *mockTransport) SetError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+}
+
+func TestReconnectAfterWriteError(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	transport := &mockTransport{conn: conn}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.queueSize = 0
+	adapter.transport = transport
+	adapter.backlog = newMemoryBacklog(10)
+
+	conn.SetError(errors.New("broken pipe"))
+	transport.SetError(errors.New("connection refused"))
+	streamLines(adapter, "one")
+	assert.Nil(adapter.endpoints[0].conn)
+	assert.Equal(0, transport.dials)
+
+	streamLines(adapter, "two")
+	assert.Equal(1, transport.dials)
+	assert.Len(conn.Writes(), 0)
+
+	conn.SetError(nil)
+	transport.SetError(nil)
+	streamLines(adapter, "three")
+	assert.Equal(2, transport.dials)
+
+	var received []string
+	for _, write := range conn.Writes() {
+		received = append(received, messages(t, write)...)
+	}
+	assert.Equal([]string{"one", "two", "three"}, received)
+	assert.True(adapter.backlog.empty())
+	assert.Equal(time.Duration(0), adapter.endpoints[0].backoff)
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{backoffMin: time.Second, backoffMax: 4 * time.Second}
+	e := &endpoint{}
+
+	for _, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		before := time.Now()
+		adapter.retryLater(e)
+		assert.Equal(expected, e.backoff)
+		wait := e.nextDial.Sub(before)
+		assert.True(wait >= expected/2 && wait <= expected+time.Second, wait)
+	}
+
+	adapter.connectionHealthy(e)
+	adapter.retryLater(e)
+	assert.Equal(time.Second, e.backoff)
+}
+
+func TestReconnectWaitsForBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	transport := &mockTransport{err: errors.New("connection refused")}
+	adapter := newBatchingAdapter("logstash+tcp", nil)
+	adapter.endpoints = []*endpoint{{address: "logstash:5000"}}
+	adapter.transport = transport
+	adapter.backoffMin = time.Hour
+	adapter.backoffMax = time.Hour
+
+	assert.NotNil(adapter.connected(adapter.endpoints[0]))
+	assert.Equal(1, transport.dials)
+	assert.Equal(errNotConnected, adapter.connected(adapter.endpoints[0]))
+	assert.Equal(1, transport.dials)
+}
+
+func TestMemoryBacklogDropsOldest(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newMemoryBacklog(3)
+	assert.Nil(b.append(events("one", "two")))
+	assert.Nil(b.append(events("three", "four", "five")))
+	assert.Equal(uint64(2), b.Dropped())
+
+	read, err := b.peek(2)
+	assert.Nil(err)
+	assert.Equal(events("three", "four"), read)
+	assert.Nil(b.discard(1))
+
+	read, err = b.peek(10)
+	assert.Nil(err)
+	assert.Equal(events("four", "five"), read)
+}
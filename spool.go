@@ -0,0 +1,412 @@
+package logstash
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for the disk spool.
+const (
+	DefaultSpoolMaxSize     = 100 * 1024 * 1024
+	DefaultSpoolSegmentSize = 4 * 1024 * 1024
+)
+
+const (
+	spoolSegmentSuffix = ".seg"
+	spoolCursorFile    = "cursor"
+)
+
+// spoolDirs are the spool directories in use, so no two routes share one.
+var (
+	spoolDirsMu sync.Mutex
+	spoolDirs   = make(map[string]bool)
+)
+
+// configureSpool opens the disk spool as the adapter's backlog if the route
+// has a spool directory. Each route gets its own subdirectory, named by
+// spoolName so that it is found again after a restart, and a route whose
+// subdirectory is already in use is rejected until the spool is closed.
+func (a *LogstashAdapter) configureSpool() error {
+	dir := getopt(a.route, "spool_dir", "LOGSTASH_SPOOL_DIR", "")
+	if dir == "" {
+		return nil
+	}
+	name, err := spoolName(a.route)
+	if err != nil {
+		return err
+	}
+	if dir, err = filepath.Abs(filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	maxSize, err := getoptInt(a.route, "spool_max_size", "LOGSTASH_SPOOL_MAX_SIZE", DefaultSpoolMaxSize)
+	if err != nil {
+		return err
+	}
+	segmentSize, err := getoptInt(a.route, "spool_segment_size", "LOGSTASH_SPOOL_SEGMENT_SIZE", DefaultSpoolSegmentSize)
+	if err != nil {
+		return err
+	}
+
+	spoolDirsMu.Lock()
+	defer spoolDirsMu.Unlock()
+	if spoolDirs[dir] {
+		return errors.New("spool " + dir + " is used by another route, set spool_name to tell them apart")
+	}
+	s, err := openSpool(dir, int64(segmentSize), int64(maxSize))
+	if err != nil {
+		return err
+	}
+	spoolDirs[dir] = true
+	s.claimed = true
+	s.log = a.log
+	a.backlog = s
+	return nil
+}
+
+// spoolName returns the name of the spool subdirectory of a route: its
+// spool_name option, or else a hash of its adapter and address. Route IDs
+// can't be used, as logspout only assigns them after creating the adapter
+// and they change on every start.
+func spoolName(route *router.Route) (string, error) {
+	if name := route.Options["spool_name"]; name != "" {
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			return "", errors.New("invalid spool_name: " + name)
+		}
+		return name, nil
+	}
+	h := fnv.New64a()
+	io.WriteString(h, route.Adapter+"\x00"+route.Address)
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
+
+// spool is an append-only queue of events on disk, split into numbered
+// segment files. Each record is a four byte big-endian length, followed by
+// the length of the event's key in one byte, the key and the event. The
+// read position is kept in a cursor file so events that were spooled but
+// not yet delivered survive a restart. Once the spool holds more than
+// maxSize bytes, whole segments are dropped oldest first.
+//
+// A spool is not safe for concurrent use; only the adapter's writer touches it.
+// It implements backlog.
+type spool struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	segments []uint64 // segment ids, oldest first
+	next     uint64   // id of the next segment, never reused
+	offset   int64    // read offset into the oldest segment
+	size     int64    // unread bytes across all segments
+	w        *os.File // segment being appended to, if any
+	wsize    int64
+
+	peeked  []spoolPos // position after each event of the last peek
+	peekEnd spoolPos   // position after the last peek, including skipped data
+	dropped uint64
+	claimed bool // whether the spool holds its dir in spoolDirs
+	log     *logger
+}
+
+// spoolPos is a read position in the spool.
+type spoolPos struct {
+	segment uint64
+	offset  int64
+}
+
+func openSpool(dir string, segmentSize, maxSize int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if segmentSize > maxSize {
+		segmentSize = maxSize
+	}
+	s := &spool{dir: dir, segmentSize: segmentSize, maxSize: maxSize, next: 1}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		var id uint64
+		if !strings.HasSuffix(f.Name(), spoolSegmentSuffix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(f.Name(), "%d"+spoolSegmentSuffix, &id); err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.size += f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	if len(s.segments) > 0 {
+		s.next = s.segments[len(s.segments)-1] + 1
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, spoolCursorFile)); err == nil {
+		var pos spoolPos
+		if _, err := fmt.Sscanf(string(b), "%d %d", &pos.segment, &pos.offset); err == nil {
+			for len(s.segments) > 0 && s.segments[0] < pos.segment {
+				s.removeHead()
+			}
+			if len(s.segments) > 0 && s.segments[0] == pos.segment {
+				s.offset = pos.offset
+				s.size -= pos.offset
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentSuffix))
+}
+
+// empty reports whether every spooled event has been committed.
+func (s *spool) empty() bool {
+	return s.size <= 0
+}
+
+// Dropped returns the number of events discarded because the spool was full.
+func (s *spool) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// append adds events to the end of the spool and syncs them to disk.
+// Segments left over from a previous run are never appended to, in case
+// their last record was cut short.
+func (s *spool) append(events []event) error {
+	for _, ev := range events {
+		if s.w == nil || s.wsize >= s.segmentSize {
+			if err := s.roll(); err != nil {
+				return err
+			}
+		}
+		key := ev.key
+		if len(key) > 255 {
+			key = key[:255]
+		}
+		record := make([]byte, 5, 5+len(key)+len(ev.data))
+		binary.BigEndian.PutUint32(record, uint32(1+len(key)+len(ev.data)))
+		record[4] = byte(len(key))
+		record = append(append(record, key...), ev.data...)
+		if _, err := s.w.Write(record); err != nil {
+			return err
+		}
+		s.wsize += int64(len(record))
+		s.size += int64(len(record))
+	}
+	if err := s.w.Sync(); err != nil {
+		return err
+	}
+	s.enforceMaxSize()
+	return nil
+}
+
+// roll closes the current segment and starts a new one.
+func (s *spool) roll() error {
+	if s.w != nil {
+		s.w.Close()
+		s.w = nil
+	}
+	id := s.next
+	f, err := os.OpenFile(s.path(id), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	s.next++
+	s.segments = append(s.segments, id)
+	s.w, s.wsize = f, 0
+	if len(s.segments) == 1 {
+		// the cursor moves on to the first segment of an empty spool
+		s.offset = 0
+		return s.writeCursor(spoolPos{segment: id})
+	}
+	return nil
+}
+
+// enforceMaxSize drops the oldest segments until the spool fits in maxSize,
+// counting the unread events they held.
+func (s *spool) enforceMaxSize() {
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		events, _, _, _ := s.readSegment(s.segments[0], s.offset, -1)
+		atomic.AddUint64(&s.dropped, uint64(len(events)))
+		s.log.warnf("spool full, dropped %d events", len(events))
+		s.removeHead()
+	}
+}
+
+// removeHead deletes the oldest segment.
+func (s *spool) removeHead() {
+	id := s.segments[0]
+	if s.w != nil && len(s.segments) == 1 {
+		s.w.Close()
+		s.w = nil
+	}
+	if fi, err := os.Stat(s.path(id)); err == nil {
+		s.size -= fi.Size() - s.offset
+	}
+	os.Remove(s.path(id))
+	s.segments = s.segments[1:]
+	s.offset = 0
+}
+
+// peek returns up to max events from the head of the spool without
+// removing them.
+func (s *spool) peek(max int) ([]event, error) {
+	events, ends, pos, err := s.read(max)
+	s.peeked, s.peekEnd = ends, pos
+	return events, err
+}
+
+// discard removes the first n events returned by the last peek. Discarding
+// nothing after an empty peek skips over records cut short by a crash.
+func (s *spool) discard(n int) error {
+	if n == 0 && len(s.peeked) > 0 {
+		return nil
+	}
+	pos := s.peekEnd
+	if n < len(s.peeked) {
+		pos = s.peeked[n-1]
+	}
+	s.peeked = nil
+	return s.commit(pos)
+}
+
+// read returns up to max events from the head of the spool, the position
+// after each of them, and the position after the last segment it read.
+func (s *spool) read(max int) ([]event, []spoolPos, spoolPos, error) {
+	var events []event
+	var ends []spoolPos
+	pos := spoolPos{offset: s.offset}
+	if len(s.segments) > 0 {
+		pos.segment = s.segments[0]
+	}
+	for i, id := range s.segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = s.offset
+		}
+		more, offsets, eof, err := s.readSegment(id, offset, max-len(events))
+		if err != nil {
+			return events, ends, pos, err
+		}
+		events = append(events, more...)
+		for _, offset := range offsets {
+			pos = spoolPos{segment: id, offset: offset}
+			ends = append(ends, pos)
+		}
+		if eof && !s.writing(id) {
+			// nothing more will be added to this segment
+			pos = spoolPos{segment: id + 1}
+		}
+		if len(events) >= max {
+			break
+		}
+	}
+	return events, ends, pos, nil
+}
+
+// writing reports whether id is the segment being appended to.
+func (s *spool) writing(id uint64) bool {
+	return s.w != nil && id == s.segments[len(s.segments)-1]
+}
+
+// readSegment reads up to max events, or all of them if max is negative,
+// starting at offset. It returns the offset after each event and whether it
+// reached the end of the segment. A record cut short by a crash, or with a
+// length longer than the rest of the segment, ends the segment.
+func (s *spool) readSegment(id uint64, offset int64, max int) ([]event, []int64, bool, error) {
+	f, err := os.Open(s.path(id))
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, false, err
+	}
+
+	var events []event
+	var offsets []int64
+	for max < 0 || len(events) < max {
+		var header [4]byte
+		if _, err := io.ReadFull(f, header[:]); err != nil {
+			return events, offsets, true, nil
+		}
+		// a length beyond the end of the segment is corrupt
+		length := int64(binary.BigEndian.Uint32(header[:]))
+		if length > fi.Size()-offset-int64(len(header)) {
+			return events, offsets, true, nil
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(f, record); err != nil || len(record) == 0 || int(record[0]) >= len(record) {
+			return events, offsets, true, nil
+		}
+		offset += int64(len(header) + len(record))
+		keyEnd := 1 + int(record[0])
+		events = append(events, event{key: string(record[1:keyEnd]), data: record[keyEnd:]})
+		offsets = append(offsets, offset)
+	}
+	return events, offsets, false, nil
+}
+
+// commit discards everything before pos and records it in the cursor file.
+func (s *spool) commit(pos spoolPos) error {
+	for len(s.segments) > 0 && s.segments[0] < pos.segment {
+		s.removeHead()
+	}
+	if len(s.segments) > 0 && s.segments[0] == pos.segment && pos.offset > s.offset {
+		s.size -= pos.offset - s.offset
+		s.offset = pos.offset
+	}
+
+	if len(s.segments) > 0 {
+		pos = spoolPos{segment: s.segments[0], offset: s.offset}
+	} else {
+		pos = spoolPos{segment: s.next}
+	}
+	return s.writeCursor(pos)
+}
+
+// writeCursor records the read position in the cursor file.
+func (s *spool) writeCursor(pos spoolPos) error {
+	cursor := filepath.Join(s.dir, spoolCursorFile)
+	tmp := cursor + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", pos.segment, pos.offset)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cursor)
+}
+
+// Close closes the segment being appended to and lets another route use
+// the spool's directory.
+func (s *spool) Close() error {
+	if s.claimed {
+		spoolDirsMu.Lock()
+		delete(spoolDirs, s.dir)
+		spoolDirsMu.Unlock()
+		s.claimed = false
+	}
+	if s.w == nil {
+		return nil
+	}
+	err := s.w.Close()
+	s.w = nil
+	return err
+}
@@ -0,0 +1,249 @@
+package logstash
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "logstash-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func events(values ...string) []event {
+	var result []event
+	for _, v := range values {
+		result = append(result, event{key: "ID", data: []byte(v)})
+	}
+	return result
+}
+
+func TestSpoolReplaysInOrderAcrossRestarts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 16, 1024)
+	assert.Nil(err)
+	assert.True(s.empty())
+
+	assert.Nil(s.append(events("one", "two", "three", "four")))
+	assert.False(s.empty())
+	assert.True(len(s.segments) > 1)
+
+	read, err := s.peek(3)
+	assert.Nil(err)
+	assert.Equal(events("one", "two", "three"), read)
+	assert.Nil(s.discard(2))
+	assert.Nil(s.Close())
+
+	s, err = openSpool(dir, 16, 1024)
+	assert.Nil(err)
+	assert.False(s.empty())
+
+	assert.Nil(s.append(events("five")))
+	read, err = s.peek(10)
+	assert.Nil(err)
+	assert.Equal(events("three", "four", "five"), read)
+	assert.Nil(s.discard(3))
+	assert.True(s.empty())
+	assert.Equal(uint64(0), s.Dropped())
+}
+
+func TestSpoolKeepsEventsSpooledAfterDraining(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1024, 4096)
+	assert.Nil(err)
+	assert.Nil(s.append(events("one")))
+	assert.Nil(s.Close())
+
+	// the spool is drained after a restart, and then used again
+	s, err = openSpool(dir, 1024, 4096)
+	assert.Nil(err)
+	read, err := s.peek(10)
+	assert.Nil(err)
+	assert.Equal(events("one"), read)
+	assert.Nil(s.discard(1))
+	assert.True(s.empty())
+	assert.Nil(s.append(events("two", "three")))
+	assert.Nil(s.Close())
+
+	s, err = openSpool(dir, 1024, 4096)
+	assert.Nil(err)
+	assert.False(s.empty())
+	read, err = s.peek(10)
+	assert.Nil(err)
+	assert.Equal(events("two", "three"), read)
+	assert.Nil(s.Close())
+}
+
+func TestSpoolDropsOldestWhenFull(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// every segment holds two 13 byte records
+	s, err := openSpool(dir, 26, 52)
+	assert.Nil(err)
+
+	assert.Nil(s.append(events("aaaaaa", "bbbbbb", "cccccc", "dddddd", "eeeeee")))
+	assert.Equal(uint64(2), s.Dropped())
+
+	read, err := s.peek(10)
+	assert.Nil(err)
+	assert.Equal(events("cccccc", "dddddd", "eeeeee"), read)
+}
+
+func TestSpoolSkipsTruncatedRecord(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1024, 1024)
+	assert.Nil(err)
+	assert.Nil(s.append(events("one", "two")))
+	path := s.path(s.segments[0])
+	assert.Nil(s.Close())
+	assert.Nil(os.Truncate(path, 14))
+
+	s, err = openSpool(dir, 1024, 1024)
+	assert.Nil(err)
+	read, err := s.peek(10)
+	assert.Nil(err)
+	assert.Equal(events("one"), read)
+	assert.Nil(s.discard(1))
+	assert.True(s.empty())
+}
+
+func TestSpoolSkipsCorruptLength(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := openSpool(dir, 1024, 1024)
+	assert.Nil(err)
+	assert.Nil(s.append(events("one", "two")))
+	path := s.path(s.segments[0])
+	assert.Nil(s.Close())
+
+	// the second record claims to be 4 GiB long
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	assert.Nil(err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 10)
+	assert.Nil(err)
+	assert.Nil(f.Close())
+
+	s, err = openSpool(dir, 1024, 1024)
+	assert.Nil(err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	read, err := s.peek(10)
+	runtime.ReadMemStats(&after)
+	assert.Nil(err)
+	assert.Equal(events("one"), read)
+	assert.True(after.TotalAlloc-before.TotalAlloc < 1<<20, "allocated %d bytes", after.TotalAlloc-before.TotalAlloc)
+}
+
+func TestAdapterSpoolsWhileLogstashIsDown(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	conn := &recordingConn{}
+	adapter := newBatchingAdapter("logstash+tcp", conn)
+	adapter.queueSize = 0
+	adapter.transport = &mockTransport{conn: conn}
+	adapter.backlog, _ = openSpool(dir, DefaultSpoolSegmentSize, DefaultSpoolMaxSize)
+
+	conn.SetError(errors.New("connection refused"))
+	streamLines(adapter, "one", "two")
+	assert.Len(conn.Writes(), 0)
+	assert.False(adapter.backlog.empty())
+
+	conn.SetError(nil)
+	streamLines(adapter, "three")
+
+	var received []string
+	for _, write := range conn.Writes() {
+		received = append(received, messages(t, write)...)
+	}
+	assert.Equal([]string{"one", "two", "three"}, received)
+	assert.True(adapter.backlog.empty())
+}
+
+func TestConfigureSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	spoolAdapter := func(adapter, address string, opts map[string]string) *LogstashAdapter {
+		opts["spool_dir"] = dir
+		return &LogstashAdapter{route: &router.Route{Adapter: adapter, Address: address, Options: opts}}
+	}
+
+	// routes without IDs, as logspout creates them, get a spool each
+	tcp := spoolAdapter("logstash+tcp", "logstash:5000", map[string]string{})
+	assert.Nil(tcp.configureSpool())
+	udp := spoolAdapter("logstash", "logstash:5000", map[string]string{})
+	assert.Nil(udp.configureSpool())
+	assert.NotEqual(tcp.backlog.(*spool).dir, udp.backlog.(*spool).dir)
+
+	// which is the same after a restart
+	name, err := spoolName(&router.Route{Adapter: "logstash+tcp", Address: "logstash:5000", ID: "new"})
+	assert.Nil(err)
+	assert.Equal(filepath.Join(dir, name), tcp.backlog.(*spool).dir)
+
+	assert.NotNil(spoolAdapter("logstash+tcp", "logstash:5000", map[string]string{}).configureSpool())
+
+	named := spoolAdapter("logstash+tcp", "logstash:5000", map[string]string{"spool_name": "audit"})
+	assert.Nil(named.configureSpool())
+	assert.Equal(filepath.Join(dir, "audit"), named.backlog.(*spool).dir)
+	assert.NotNil(spoolAdapter("logstash", "other:5000", map[string]string{"spool_name": "audit"}).configureSpool())
+	assert.NotNil(spoolAdapter("logstash", "other:5000", map[string]string{"spool_name": "../audit"}).configureSpool())
+
+	// closing a spool lets the route be created again
+	assert.Nil(named.backlog.Close())
+	again := spoolAdapter("logstash+tcp", "logstash:5000", map[string]string{"spool_name": "audit"})
+	assert.Nil(again.configureSpool())
+	for _, a := range []*LogstashAdapter{tcp, udp, again} {
+		assert.Nil(a.backlog.Close())
+	}
+}
+
+func TestNewAdapterReleasesSpool(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+
+	// a route that fails after its spool is opened can be tried again
+	route := &router.Route{Adapter: "logstash+elasticsearch", Address: "es:9200", Options: map[string]string{
+		"spool_dir": dir,
+		"balance":   "nonsense",
+	}}
+	for i := 0; i < 2; i++ {
+		_, err := NewLogstashAdapter(route)
+		assert.NotNil(err)
+		assert.NotContains(err.Error(), "spool")
+	}
+}
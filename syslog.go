@@ -0,0 +1,257 @@
+package logstash
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gliderlabs/logspout/router"
+)
+
+// Defaults for syslog messages. 32473 is the private enterprise number
+// reserved for documentation by RFC 5612; sites with their own should use it.
+const (
+	DefaultSyslogFacility     = "daemon"
+	DefaultSyslogEnterpriseID = "32473"
+)
+
+// RFC 5424 allows at most six digits of fractional seconds.
+const syslogTimeFormat = "2006-01-02T15:04:05.999999Z07:00"
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+var enterpriseIDPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// bom marks a message as UTF-8, which RFC 5424 requires for anything that
+// isn't plain ASCII.
+const bom = "\xef\xbb\xbf"
+
+// configureSyslog reads the facility of syslog messages and the enterprise
+// number their structured data is named with.
+func (a *LogstashAdapter) configureSyslog() error {
+	facility := getopt(a.route, "syslog_facility", "LOGSTASH_SYSLOG_FACILITY", DefaultSyslogFacility)
+	if n, ok := syslogFacilities[facility]; ok {
+		a.syslogFacility = n
+	} else if n, err := strconv.Atoi(facility); err == nil && n >= 0 && n <= 23 {
+		a.syslogFacility = n
+	} else {
+		return errors.New("unknown syslog_facility: " + facility)
+	}
+
+	a.enterpriseID = getopt(a.route, "syslog_enterprise_id", "LOGSTASH_SYSLOG_ENTERPRISE_ID", DefaultSyslogEnterpriseID)
+	if !enterpriseIDPattern.MatchString(a.enterpriseID) {
+		return errors.New("invalid syslog_enterprise_id: " + a.enterpriseID)
+	}
+	return nil
+}
+
+// encodeSyslog renders an event as an RFC 5424 message. APP-NAME is the
+// container's name, PROCID its ID and MSGID the stream. Every object of the
+// event, such as the docker and kubernetes metadata, becomes an element of
+// the structured data, and its other fields form a "fields" element. On
+// stream transports messages are framed by octet counting.
+func (a *LogstashAdapter) encodeSyslog(m *router.Message, data map[string]interface{}) ([]byte, error) {
+	event, err := plainEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := "-"
+	if ts, ok := event["@timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			timestamp = t.UTC().Format(syslogTimeFormat)
+		}
+	}
+	id := m.Container.ID
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s %s",
+		a.syslogFacility*8+eventSeverity(event, m.Source),
+		timestamp,
+		syslogHeader(eventHost(m, a), 255),
+		syslogHeader(strings.TrimPrefix(m.Container.Name, "/"), 48),
+		syslogHeader(id, 128),
+		syslogHeader(m.Source, 32),
+		a.structuredData(event))
+	if message, _ := event["message"].(string); message != "" {
+		b.WriteByte(' ')
+		if !isASCII(message) {
+			b.WriteString(bom)
+		}
+		b.WriteString(message)
+	}
+
+	if a.isDatagram() {
+		return b.Bytes(), nil
+	}
+	return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...), nil
+}
+
+// structuredData returns the SD-ELEMENTs of an event, sorted by name, or
+// the nil value if it has none.
+func (a *LogstashAdapter) structuredData(event map[string]interface{}) string {
+	elements := make(map[string]map[string]string)
+	fields := make(map[string]string)
+	for k, v := range event {
+		switch k {
+		case "message", "@timestamp", "@version", "stream", "level":
+			continue
+		}
+		if inner, ok := v.(map[string]interface{}); ok {
+			params := make(map[string]string)
+			for name, value := range inner {
+				flattenSyslog(name, value, params)
+			}
+			if len(params) > 0 {
+				elements[k] = params
+			}
+			continue
+		}
+		flattenSyslog(k, v, fields)
+	}
+	if len(fields) > 0 {
+		if _, ok := elements["fields"]; !ok {
+			elements["fields"] = fields
+		}
+	}
+	if len(elements) == 0 {
+		return "-"
+	}
+
+	names := make([]string, 0, len(elements))
+	for name := range elements {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		suffix := "@" + a.enterpriseID
+		b.WriteString("[" + sdName(name, 32-len(suffix)) + suffix)
+		params := elements[name]
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteString(" " + sdName(k, 32) + `="` + sdValueEscaper.Replace(params[k]) + `"`)
+		}
+		b.WriteString("]")
+	}
+	return b.String()
+}
+
+// flattenSyslog adds a value as SD-PARAMs named after key, one per nested
+// field, with the names joined by dots. Lists are joined by commas.
+func flattenSyslog(key string, value interface{}, params map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			flattenSyslog(key+"."+k, inner, params)
+		}
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				parts = append(parts, s)
+			} else if item != nil {
+				parts = append(parts, syslogValue(item))
+			}
+		}
+		if len(parts) > 0 {
+			params[key] = strings.Join(parts, ",")
+		}
+	case nil:
+	default:
+		params[key] = syslogValue(v)
+	}
+}
+
+func syslogValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+// sdValueEscaper escapes the characters RFC 5424 doesn't allow unescaped in
+// PARAM-VALUEs.
+var sdValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// sdName makes a valid SD-NAME of at most max characters from name.
+func sdName(name string, max int) string {
+	b := []byte(name)
+	for i, c := range b {
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' || c == '@' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// syslogHeader makes a valid header field of at most max characters from s,
+// or the nil value if s is empty.
+func syslogHeader(s string, max int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,119 @@
+package logstash
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/gliderlabs/logspout/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSyslogAdapter(adapterType string, conn *recordingConn) *LogstashAdapter {
+	adapter := newBatchingAdapter(adapterType, conn)
+	adapter.format = FormatSyslog
+	adapter.syslogFacility = syslogFacilities[DefaultSyslogFacility]
+	adapter.enterpriseID = DefaultSyslogEnterpriseID
+	return adapter
+}
+
+// syslogFrames splits an octet counted stream into its messages.
+func syslogFrames(t *testing.T, stream string) []string {
+	var frames []string
+	for stream != "" {
+		i := strings.IndexByte(stream, ' ')
+		n, err := strconv.Atoi(stream[:i])
+		assert.Nil(t, err)
+		frames = append(frames, stream[i+1:i+1+n])
+		stream = stream[i+1+n:]
+	}
+	return frames
+}
+
+func TestSyslogOverTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	streamLines(newSyslogAdapter("logstash+tcp", conn),
+		`{"message": "café \"au\" lait]", "level": "warn", "user": {"id": 7, "roles": ["a", "b"]}, "count": 3}`,
+		"second\nline")
+
+	frames := syslogFrames(t, strings.Join(conn.Writes(), ""))
+	assert.Len(frames, 2)
+
+	header := regexp.MustCompile(`^<28>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d{1,6})?Z banana-potato name ID stdout `)
+	assert.Regexp(header, frames[0])
+	assert.Contains(frames[0], ` [docker@32473 hostname="hostname" id="ID" image="image" name="name"]`+
+		`[fields@32473 count="3"]`+
+		`[user@32473 id="7" roles="a,b"] `+bom+`café "au" lait]`)
+
+	assert.True(strings.HasPrefix(frames[1], "<30>1 "))
+	assert.True(strings.HasSuffix(frames[1], "] second\nline"))
+}
+
+func TestSyslogOverUDP(t *testing.T) {
+	assert := assert.New(t)
+
+	conn := &recordingConn{}
+	adapter := newSyslogAdapter("logstash", conn)
+	adapter.enterpriseID = "1234.5"
+	streamLines(adapter, "plain")
+
+	writes := conn.Writes()
+	assert.Len(writes, 1)
+	assert.True(strings.HasPrefix(writes[0], "<30>1 "))
+	assert.Contains(writes[0], "[docker@1234.5 ")
+	assert.True(strings.HasSuffix(writes[0], "] plain"))
+}
+
+func TestSyslogStructuredData(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := newSyslogAdapter("logstash", &recordingConn{})
+	m := &router.Message{
+		Container: &docker.Container{ID: "0123456789abcdef", Name: "/web", Config: &docker.Config{}},
+		Source:    "stderr",
+		Time:      time.Date(2023, 4, 5, 6, 7, 8, 123456789, time.UTC),
+	}
+	data := map[string]interface{}{
+		"@timestamp": "2023-04-05T06:07:08.123456789Z",
+		"kubernetes": map[string]string{"namespace": "prod", "labels_app": `a\b`},
+		"empty":      map[string]interface{}{},
+		"tags":       []string{},
+	}
+	msg, err := adapter.encodeSyslog(m, data)
+	assert.Nil(err)
+
+	// stderr maps to err, and the message is left out when there is none
+	assert.Equal(`<27>1 2023-04-05T06:07:08.123456Z banana-potato web 0123456789ab stderr `+
+		`[kubernetes@32473 labels_app="a\\b" namespace="prod"]`, string(msg))
+
+	msg, err = adapter.encodeSyslog(m, map[string]interface{}{"message": "m"})
+	assert.Nil(err)
+	assert.True(strings.HasSuffix(string(msg), " stderr - m"))
+}
+
+func TestConfigureSyslog(t *testing.T) {
+	assert := assert.New(t)
+
+	adapter := &LogstashAdapter{route: newRoute(map[string]string{"format": "syslog"})}
+	assert.Nil(adapter.configureFormat())
+	assert.Equal(3, adapter.syslogFacility)
+	assert.Equal("32473", adapter.enterpriseID)
+
+	adapter.route.Options["syslog_facility"] = "local3"
+	adapter.route.Options["syslog_enterprise_id"] = "1234.5.6"
+	assert.Nil(adapter.configureFormat())
+	assert.Equal(19, adapter.syslogFacility)
+	assert.Equal("1234.5.6", adapter.enterpriseID)
+
+	adapter.route.Options["syslog_facility"] = "24"
+	assert.NotNil(adapter.configureFormat())
+
+	adapter.route.Options["syslog_facility"] = "user"
+	adapter.route.Options["syslog_enterprise_id"] = "acme"
+	assert.NotNil(adapter.configureFormat())
+}